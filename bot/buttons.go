@@ -0,0 +1,253 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/robertkozin/discord-video-preview-bot/preview"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxRowButtons is the most buttons Discord accepts in one action row.
+	maxRowButtons = 5
+
+	deleteButtonPrefix = "preview_delete"
+	retryButtonPrefix  = "preview_retry"
+
+	// maxButtonURL is the longest url Discord accepts on a link button.
+	maxButtonURL = 512
+
+	// deleteReaction lets the author dismiss a reply from clients that don't
+	// show buttons.
+	deleteReaction = "❌"
+)
+
+// replyButtons returns the delete and retry buttons for a reply and a link to
+// each original post. Custom ids, which Discord limits to 100 characters, carry
+// the source message id, and for retry the positions of this reply's links
+// among the links recorded for the source message, e.g.
+//
+//	preview_retry:1234567890123456789:0,1,2
+func replyButtons(sourceID string, previews []linkPreview) []discordgo.MessageComponent {
+	indexes := make([]string, len(previews))
+	for i, p := range previews {
+		indexes[i] = strconv.Itoa(p.index)
+	}
+
+	buttons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "Delete",
+			Style:    discordgo.SecondaryButton,
+			Emoji:    &discordgo.ComponentEmoji{Name: "🗑️"},
+			CustomID: deleteButtonPrefix + ":" + sourceID,
+		},
+		discordgo.Button{
+			Label:    "Retry",
+			Style:    discordgo.SecondaryButton,
+			Emoji:    &discordgo.ComponentEmoji{Name: "🔁"},
+			CustomID: retryButtonPrefix + ":" + sourceID + ":" + strings.Join(indexes, ","),
+		},
+	}
+	for i, p := range previews {
+		url, ok := buttonURL(p.url)
+		if !ok {
+			continue
+		}
+		label := "Open original"
+		if len(previews) > 1 {
+			label = fmt.Sprintf("Original %d", i+1)
+		}
+		buttons = append(buttons, discordgo.Button{
+			Label: label,
+			Style: discordgo.LinkButton,
+			URL:   url,
+		})
+	}
+	return buttons
+}
+
+// buttonURL shortens a link that is too long for a link button by dropping its
+// tracking parameters, and reports false when that isn't enough.
+func buttonURL(url string) (string, bool) {
+	if len(url) <= maxButtonURL {
+		return url, true
+	}
+	clean, err := preview.CleanURL(url)
+	if err != nil || len(clean) > maxButtonURL {
+		return "", false
+	}
+	return clean, true
+}
+
+func (b *Discord) buttonHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	parts := strings.Split(i.MessageComponentData().CustomID, ":")
+	if len(parts) < 2 {
+		return
+	}
+	sourceID := parts[1]
+
+	if !b.canManageReply(i, sourceID) {
+		_ = respondEphemeral(s, i, "Only the person who posted the link or a moderator can do that.")
+		return
+	}
+
+	switch parts[0] {
+	case deleteButtonPrefix:
+		b.deleteButton(s, i, sourceID)
+	case retryButtonPrefix:
+		if len(parts) < 3 {
+			return
+		}
+		b.retryButton(s, i, sourceID, strings.Split(parts[2], ","))
+	}
+}
+
+// canManageReply allows the author of the source message and anyone who may
+// manage messages in the channel.
+func (b *Discord) canManageReply(i *discordgo.InteractionCreate, sourceID string) bool {
+	if i.Member != nil && i.Member.Permissions&discordgo.PermissionManageMessages != 0 {
+		return true
+	}
+	record, ok := b.Store.Reply(sourceID)
+	return ok && record.AuthorID == interactionUserID(i)
+}
+
+func (b *Discord) deleteButton(s *discordgo.Session, i *discordgo.InteractionCreate, sourceID string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		return
+	}
+	if err := s.ChannelMessageDelete(i.ChannelID, i.Message.ID); err != nil {
+		return
+	}
+	_ = b.Store.RemoveReplyMessage(sourceID, i.Message.ID)
+}
+
+// retryButton reuploads the links of a reply from scratch and swaps in the new
+// media, keeping the reply's text. indexes are positions in the record's urls.
+func (b *Discord) retryButton(s *discordgo.Session, i *discordgo.InteractionCreate, sourceID string, indexes []string) {
+	record, ok := b.Store.Reply(sourceID)
+	if !ok {
+		_ = respondEphemeral(s, i, "That preview is too old to retry.")
+		return
+	}
+
+	var links []linkPreview
+	for _, raw := range indexes {
+		index, err := strconv.Atoi(raw)
+		if err != nil || index < 0 || index >= len(record.URLs) {
+			continue
+		}
+		links = append(links, linkPreview{url: record.URLs[index], index: index, spoiler: replySpoiler(i.Message)})
+	}
+	if len(links) == 0 {
+		_ = respondEphemeral(s, i, "That preview is too old to retry.")
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		return
+	}
+
+	go func() {
+		ctx, span := tracer.Start(context.Background(), "discord_retry", trace.WithAttributes(
+			attribute.String("guild_id", i.GuildID),
+			attribute.String("channel_id", i.ChannelID),
+			attribute.String("message_id", sourceID),
+			attribute.StringSlice("indexes", indexes),
+		))
+		defer span.End()
+
+		ctx = preview.WithTenant(ctx, preview.Tenant{GuildID: i.GuildID})
+		previews, err := b.reuploadAll(ctx, links, b.Reuploader.Refresh)
+		previews, nsfwErr := b.applyNSFWPolicy(s, b.Store.GuildConfig(i.GuildID), i.ChannelID, previews)
+		err = errors.Join(err, nsfwErr)
+		if len(previews) == 0 {
+			span.RecordError(err)
+			span.SetStatus(1, err.Error())
+			_, _ = s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+				Content: "Sorry, retrying didn't work either.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			})
+			return
+		}
+
+		reply := b.buildReply(sourceID, previews)
+		if text, ok := replyText(i.Message); ok {
+			reply.Components[0] = discordgo.TextDisplay{Content: text}
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Components: &reply.Components,
+		})
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(1, err.Error())
+		}
+	}()
+}
+
+// messageReactionAddHandler deletes a reply when its author reacts with
+// deleteReaction. Moderators can delete the reply directly instead.
+func (b *Discord) messageReactionAddHandler(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.Emoji.Name != deleteReaction || r.UserID == b.id {
+		return
+	}
+	sourceID, record, ok := b.Store.ReplySource(r.MessageID)
+	if !ok || record.AuthorID != r.UserID {
+		return
+	}
+	if err := s.ChannelMessageDelete(r.ChannelID, r.MessageID); err != nil {
+		return
+	}
+	_ = b.Store.RemoveReplyMessage(sourceID, r.MessageID)
+}
+
+// replyText returns the text the bot put at the top of a reply.
+func replyText(m *discordgo.Message) (string, bool) {
+	if m == nil || len(m.Components) == 0 {
+		return "", false
+	}
+	text, ok := m.Components[0].(*discordgo.TextDisplay)
+	if !ok {
+		return "", false
+	}
+	return text.Content, true
+}
+
+// replySpoiler reports whether any media of a reply was spoilered, which is
+// then kept hidden when the reply is rebuilt.
+func replySpoiler(m *discordgo.Message) bool {
+	for _, c := range m.Components {
+		gallery, ok := c.(*discordgo.MediaGallery)
+		if !ok {
+			continue
+		}
+		for _, item := range gallery.Items {
+			if item.Spoiler {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
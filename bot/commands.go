@@ -0,0 +1,269 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/robertkozin/discord-video-preview-bot/preview"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// command is an application command and the handler for its interactions.
+type command struct {
+	def    *discordgo.ApplicationCommand
+	handle func(s *discordgo.Session, i *discordgo.InteractionCreate)
+}
+
+func (b *Discord) commands() []command {
+	return []command{
+		{
+			def: &discordgo.ApplicationCommand{
+				Name:        "preview",
+				Description: "Reupload the media of a link so it plays inline",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "url",
+						Description: "Link to the post",
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionBoolean,
+						Name:        "spoiler",
+						Description: "Hide the media behind a spoiler",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionBoolean,
+						Name:        "silent",
+						Description: "Post without sending notifications",
+					},
+				},
+			},
+			handle: b.previewCommand,
+		},
+		{
+			def: &discordgo.ApplicationCommand{
+				Type:                     discordgo.MessageApplicationCommand,
+				Name:                     "Preview media",
+				DefaultMemberPermissions: &manageMessages,
+			},
+			handle: b.previewMessageCommand,
+		},
+		b.configCommand(),
+		{
+			def: &discordgo.ApplicationCommand{
+				Name:        "preview-optout",
+				Description: "Stop or start previewing links in your messages",
+			},
+			handle: b.optOutCommand,
+		},
+	}
+}
+
+// registerCommands replaces the bot's global commands with the ones it handles.
+func (b *Discord) registerCommands(s *discordgo.Session, appID string) error {
+	cmds := b.commands()
+	defs := make([]*discordgo.ApplicationCommand, len(cmds))
+	for i, cmd := range cmds {
+		defs[i] = cmd.def
+	}
+	_, err := s.ApplicationCommandBulkOverwrite(appID, "", defs)
+	if err != nil {
+		return fmt.Errorf("registering commands: %w", err)
+	}
+	return nil
+}
+
+func (b *Discord) interactionCreateHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+	case discordgo.InteractionMessageComponent:
+		b.buttonHandler(s, i)
+		return
+	default:
+		return
+	}
+	name := i.ApplicationCommandData().Name
+	for _, cmd := range b.commands() {
+		if cmd.def.Name == name {
+			cmd.handle(s, i)
+			return
+		}
+	}
+}
+
+func (b *Discord) previewCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	var (
+		url     string
+		spoiler bool
+		silent  bool
+	)
+	for _, opt := range i.ApplicationCommandData().Options {
+		switch opt.Name {
+		case "url":
+			url = opt.StringValue()
+		case "spoiler":
+			spoiler = opt.BoolValue()
+		case "silent":
+			silent = opt.BoolValue()
+		}
+	}
+
+	if !b.Reuploader.IsSupported(url) || !b.Store.GuildConfig(i.GuildID).platformEnabled(url) {
+		_ = respondEphemeral(s, i, "That link isn't supported.")
+		return
+	}
+
+	// reuploading can take longer than the three seconds we have to respond
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		return
+	}
+
+	go b.followupPreview(context.Background(), s, i, linkPreview{url: url, spoiler: spoiler}, silent)
+}
+
+func (b *Discord) followupPreview(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate, p linkPreview, silent bool) {
+	ctx, span := tracer.Start(ctx, "discord_command_reply", trace.WithAttributes(
+		attribute.String("guild_id", i.GuildID),
+		attribute.String("channel_id", i.ChannelID),
+		attribute.String("url", p.url),
+	))
+	defer span.End()
+
+	ctx = preview.WithTenant(ctx, preview.Tenant{GuildID: i.GuildID})
+
+	previews, err := b.reuploadAll(ctx, []linkPreview{p}, b.Reuploader.Reupload)
+	if err == nil {
+		previews, err = b.applyNSFWPolicy(s, b.Store.GuildConfig(i.GuildID), i.ChannelID, previews)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(1, err.Error())
+
+		// the deferred response is public, so replace it with a private error
+		_ = s.InteractionResponseDelete(i.Interaction)
+		_, _ = s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+			Content: failureMessage(err),
+			Flags:   discordgo.MessageFlagsEphemeral,
+		})
+		return
+	}
+
+	// there is no embed to summarize, so show the link itself
+	p = previews[0]
+	p.embed = &discordgo.MessageEmbed{Description: p.url}
+
+	reply := b.buildReply(i.ID, []linkPreview{p})
+	if silent {
+		reply.Flags |= discordgo.MessageFlagsSuppressNotifications
+	}
+
+	sent, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+		Components:      reply.Components,
+		Flags:           reply.Flags,
+		AllowedMentions: reply.AllowedMentions,
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(1, err.Error())
+		return
+	}
+
+	// the interaction stands in for the source message so the buttons work
+	err = b.Store.SetReply(i.ID, ReplyRecord{
+		ChannelID: i.ChannelID,
+		AuthorID:  interactionUserID(i),
+		ReplyIDs:  []string{sent.ID},
+		URLs:      []string{p.url},
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+}
+
+// previewMessageCommand runs the same pipeline as a new message on an existing
+// one, e.g. to fix up posts from before the bot joined or retry a failed
+// preview. The reply goes to the channel and the invoker gets a private status.
+// Since it posts on someone else's behalf only moderators see it by default,
+// and the embeds are left alone unless the author ran it themselves.
+func (b *Discord) previewMessageCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	// the default permissions can be overridden per server, so check again
+	if i.Member == nil || i.Member.Permissions&discordgo.PermissionManageMessages == 0 {
+		_ = respondEphemeral(s, i, "You need the Manage Messages permission to preview other messages.")
+		return
+	}
+
+	data := i.ApplicationCommandData()
+	m, ok := data.Resolved.Messages[data.TargetID]
+	if !ok {
+		return
+	}
+	// resolved messages leave out the guild
+	m.GuildID = i.GuildID
+
+	if m.Author != nil && b.Store.OptedOut(m.Author.ID) {
+		_ = respondEphemeral(s, i, "The author of that message opted out of previews.")
+		return
+	}
+
+	links := b.findLinks(m.Content, b.Store.GuildConfig(i.GuildID))
+	if len(links) == 0 {
+		_ = respondEphemeral(s, i, "That message has no supported links.")
+		return
+	}
+
+	if !b.startReplying(m.ID) {
+		_ = respondEphemeral(s, i, "That message is already being previewed.")
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		b.doneReplying(m.ID)
+		return
+	}
+
+	go func() {
+		defer b.doneReplying(m.ID)
+		status := "Done."
+		byAuthor := m.Author != nil && m.Author.ID == interactionUserID(i)
+		if err := b.replyToMessage(context.Background(), s, m, links, byAuthor); err != nil {
+			status = failureMessage(err)
+		}
+		_, _ = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &status,
+		})
+	}()
+}
+
+func (b *Discord) optOutCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	optedOut, err := b.Store.ToggleOptOut(interactionUserID(i))
+	switch {
+	case err != nil:
+		_ = respondEphemeral(s, i, "Sorry, I couldn't save that.")
+	case optedOut:
+		_ = respondEphemeral(s, i, "Got it, I'll leave your messages alone. Run this again to opt back in.")
+	default:
+		_ = respondEphemeral(s, i, "Welcome back, I'll preview links in your messages again.")
+	}
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) error {
+	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
@@ -0,0 +1,369 @@
+package bot
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	manageGuild    int64 = discordgo.PermissionManageGuild
+	manageMessages int64 = discordgo.PermissionManageMessages
+)
+
+func choices(values ...string) []*discordgo.ApplicationCommandOptionChoice {
+	out := make([]*discordgo.ApplicationCommandOptionChoice, len(values))
+	for i, v := range values {
+		out[i] = &discordgo.ApplicationCommandOptionChoice{Name: v, Value: v}
+	}
+	return out
+}
+
+func platformChoices() []*discordgo.ApplicationCommandOptionChoice {
+	names := make([]string, len(platforms))
+	for i, p := range platforms {
+		names[i] = p.name
+	}
+	return choices(names...)
+}
+
+// configCommand is /preview-config, which only members who can manage the
+// server see and may use.
+func (b *Discord) configCommand() command {
+	return command{
+		def: &discordgo.ApplicationCommand{
+			Name:                     "preview-config",
+			Description:              "Change how the bot behaves in this server",
+			DefaultMemberPermissions: &manageGuild,
+			Contexts:                 &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show the current settings",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "mode",
+					Description: "Preview every link automatically or only on command",
+					Options: []*discordgo.ApplicationCommandOption{{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "value",
+						Description: "auto or command",
+						Required:    true,
+						Choices:     choices(ModeAuto, ModeCommand),
+					}},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "channel",
+					Description: "Limit automatic previews to some channels or categories",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "action",
+							Description: "add or remove a channel, or clear to allow every channel",
+							Required:    true,
+							Choices:     choices("add", "remove", "clear"),
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionChannel,
+							Name:        "channel",
+							Description: "Channel or category",
+							ChannelTypes: []discordgo.ChannelType{
+								discordgo.ChannelTypeGuildText,
+								discordgo.ChannelTypeGuildNews,
+								discordgo.ChannelTypeGuildForum,
+								discordgo.ChannelTypeGuildCategory,
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "platform",
+					Description: "Turn previews for a site on or off",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "name",
+							Description: "Site",
+							Required:    true,
+							Choices:     platformChoices(),
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "enabled",
+							Description: "Whether to preview its links",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "role",
+					Description: "Ignore messages from members of some roles",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "action",
+							Description: "add or remove an ignored role, or clear them all",
+							Required:    true,
+							Choices:     choices("add", "remove", "clear"),
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionRole,
+							Name:        "role",
+							Description: "Role",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "bots",
+					Description: "Preview links posted by other bots and webhooks",
+					Options: []*discordgo.ApplicationCommandOption{{
+						Type:        discordgo.ApplicationCommandOptionBoolean,
+						Name:        "allow",
+						Description: "Whether to preview them",
+						Required:    true,
+					}},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "embeds",
+					Description: "Hide Discord's own embeds on previewed messages",
+					Options: []*discordgo.ApplicationCommandOption{{
+						Type:        discordgo.ApplicationCommandOptionBoolean,
+						Name:        "hide",
+						Description: "Whether to hide them",
+						Required:    true,
+					}},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "reply",
+					Description: "Post previews as replies or plain messages",
+					Options: []*discordgo.ApplicationCommandOption{{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "style",
+						Description: "auto replies once the conversation has moved on",
+						Required:    true,
+						Choices:     choices(ReplyAuto, ReplyAlways, ReplyMessage),
+					}},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "feedback",
+					Description: "Show progress and explain failures",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "progress",
+							Description: "How to show that a link is being worked on",
+							Choices:     choices(ProgressReaction, ProgressTyping, ProgressOff),
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "failure_replies",
+							Description: "Reply with why a link couldn't be previewed",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "nsfw",
+					Description: "Handle media marked as NSFW outside age-restricted channels",
+					Options: []*discordgo.ApplicationCommandOption{{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "policy",
+						Description: "skip it, hide it behind a spoiler, or allow it",
+						Required:    true,
+						Choices:     choices(NSFWSkip, NSFWSpoiler, NSFWAllow),
+					}},
+				},
+			},
+		},
+		handle: b.handleConfigCommand,
+	}
+}
+
+func (b *Discord) handleConfigCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	// the default permissions can be overridden per server, so check again
+	if i.Member == nil || i.Member.Permissions&discordgo.PermissionManageGuild == 0 {
+		_ = respondEphemeral(s, i, "You need the Manage Server permission to change settings.")
+		return
+	}
+
+	sub := i.ApplicationCommandData().Options[0]
+	opts := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(sub.Options))
+	for _, opt := range sub.Options {
+		opts[opt.Name] = opt
+	}
+
+	if sub.Name == "show" {
+		_ = respondEphemeral(s, i, formatGuildConfig(b.Store.GuildConfig(i.GuildID)))
+		return
+	}
+
+	var problem string
+	config, err := b.Store.UpdateGuildConfig(i.GuildID, func(c *GuildConfig) {
+		switch sub.Name {
+		case "mode":
+			c.Mode = opts["value"].StringValue()
+		case "channel":
+			c.Channels, problem = updateIDList(c.Channels, opts["action"].StringValue(), opts["channel"], "channel")
+		case "role":
+			c.IgnoredRoles, problem = updateIDList(c.IgnoredRoles, opts["action"].StringValue(), opts["role"], "role")
+		case "bots":
+			c.AllowBots = opts["allow"].BoolValue()
+		case "platform":
+			name := opts["name"].StringValue()
+			c.DisabledPlatforms = slices.DeleteFunc(c.DisabledPlatforms, func(p string) bool { return p == name })
+			if !opts["enabled"].BoolValue() {
+				c.DisabledPlatforms = append(c.DisabledPlatforms, name)
+			}
+		case "embeds":
+			c.HideEmbeds = opts["hide"].BoolValue()
+		case "reply":
+			c.Reply = opts["style"].StringValue()
+		case "feedback":
+			if opt, ok := opts["progress"]; ok {
+				c.Progress = opt.StringValue()
+			}
+			if opt, ok := opts["failure_replies"]; ok {
+				c.FailureReplies = opt.BoolValue()
+			}
+		case "nsfw":
+			c.NSFW = opts["policy"].StringValue()
+		}
+	})
+	switch {
+	case problem != "":
+		_ = respondEphemeral(s, i, problem)
+	case err != nil:
+		_ = respondEphemeral(s, i, "Sorry, I couldn't save that.")
+	default:
+		_ = respondEphemeral(s, i, "Saved.\n"+formatGuildConfig(config))
+	}
+}
+
+// updateIDList applies an add, remove or clear action to a list of channel or
+// role ids, returning a problem to show the user if the option is missing.
+func updateIDList(ids []string, action string, opt *discordgo.ApplicationCommandInteractionDataOption, what string) ([]string, string) {
+	if action == "clear" {
+		return nil, ""
+	}
+	if opt == nil {
+		return ids, "Pick a " + what + " to " + action + "."
+	}
+	id := opt.Value.(string)
+	ids = slices.DeleteFunc(ids, func(other string) bool { return other == id })
+	if action == "add" {
+		ids = append(ids, id)
+	}
+	return ids, ""
+}
+
+func formatGuildConfig(c GuildConfig) string {
+	channels := "all"
+	if len(c.Channels) > 0 {
+		mentions := make([]string, len(c.Channels))
+		for i, id := range c.Channels {
+			mentions[i] = "<#" + id + ">"
+		}
+		channels = strings.Join(mentions, ", ")
+	}
+	roles := "none"
+	if len(c.IgnoredRoles) > 0 {
+		mentions := make([]string, len(c.IgnoredRoles))
+		for i, id := range c.IgnoredRoles {
+			mentions[i] = "<@&" + id + ">"
+		}
+		roles = strings.Join(mentions, ", ")
+	}
+	disabled := "none"
+	if len(c.DisabledPlatforms) > 0 {
+		disabled = strings.Join(c.DisabledPlatforms, ", ")
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**Mode:** %s\n", c.Mode)
+	fmt.Fprintf(&sb, "**Channels:** %s\n", channels)
+	fmt.Fprintf(&sb, "**Disabled sites:** %s\n", disabled)
+	fmt.Fprintf(&sb, "**Ignored roles:** %s\n", roles)
+	fmt.Fprintf(&sb, "**Bots and webhooks:** %t\n", c.AllowBots)
+	fmt.Fprintf(&sb, "**Hide embeds:** %t\n", c.HideEmbeds)
+	fmt.Fprintf(&sb, "**Reply style:** %s\n", c.Reply)
+	fmt.Fprintf(&sb, "**Progress:** %s\n", c.Progress)
+	fmt.Fprintf(&sb, "**Failure replies:** %t\n", c.FailureReplies)
+	fmt.Fprintf(&sb, "**NSFW media:** %s", c.NSFW)
+	return sb.String()
+}
+
+// channelEnabled reports whether automatic previews are on in channelID,
+// either directly or through its parent channel or category.
+func (b *Discord) channelEnabled(s *discordgo.Session, config GuildConfig, channelID string) bool {
+	if len(config.Channels) == 0 {
+		return true
+	}
+	// threads sit in a channel, which sits in a category
+	for range 3 {
+		if slices.Contains(config.Channels, channelID) {
+			return true
+		}
+		channelID = b.channelParent(s, channelID)
+		if channelID == "" {
+			return false
+		}
+	}
+	return false
+}
+
+// channelInfo is what the bot needs to know about a channel.
+type channelInfo struct {
+	parentID string
+	nsfw     bool
+	thread   bool
+}
+
+// channel looks up channelID, remembering the answer since the bot runs
+// without a state cache. Channel and thread updates forget it again.
+func (b *Discord) channel(s *discordgo.Session, channelID string) (channelInfo, bool) {
+	if info, ok := b.channels.Load(channelID); ok {
+		return info.(channelInfo), true
+	}
+	channel, err := s.Channel(channelID)
+	if err != nil {
+		return channelInfo{}, false
+	}
+	info := channelInfo{parentID: channel.ParentID, nsfw: channel.NSFW, thread: channel.IsThread()}
+	b.channels.Store(channelID, info)
+	return info, true
+}
+
+// channelParent returns the parent of a channel, empty for channels without one.
+func (b *Discord) channelParent(s *discordgo.Session, channelID string) string {
+	info, _ := b.channel(s, channelID)
+	return info.parentID
+}
+
+func (b *Discord) channelUpdateHandler(s *discordgo.Session, c *discordgo.ChannelUpdate) {
+	b.channels.Delete(c.ID)
+}
+
+func (b *Discord) channelDeleteHandler(s *discordgo.Session, c *discordgo.ChannelDelete) {
+	b.channels.Delete(c.ID)
+}
+
+// threads come with their own events rather than channel ones
+
+func (b *Discord) threadUpdateHandler(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	b.channels.Delete(t.ID)
+}
+
+func (b *Discord) threadDeleteHandler(s *discordgo.Session, t *discordgo.ThreadDelete) {
+	b.channels.Delete(t.ID)
+}
@@ -2,12 +2,19 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"mime"
+	"net/url"
+	"path"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robertkozin/discord-video-preview-bot/preview"
+	"github.com/robertkozin/discord-video-preview-bot/tr"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -15,26 +22,40 @@ import (
 	"github.com/bwmarrin/discordgo"
 )
 
-var (
-	tracer     = otel.Tracer("bot")
-	urlPattern = regexp.MustCompile(`https://\S+`)
-)
+var tracer = otel.Tracer("bot")
 
 type Discord struct {
-	id                 string
-	session            *discordgo.Session
-	inFlightMessages   map[string]chan *discordgo.Message
-	lastChannelMessage map[string]string
+	id           string
+	session      *discordgo.Session
+	lastMessages sync.Map // channel id -> id of its latest message
+	registerOnce sync.Once
+	channels     sync.Map // channel id -> channelInfo
+	replying     sync.Map // ids of messages being replied to
 
 	Token      string
-	Reuploader preview.Reuploader
+	Reuploader Reuploader
+	// Store remembers replies so they follow their source message, in memory
+	// only when nil.
+	Store *Store
+}
+
+// Reuploader is implemented by *preview.Reuploader and *preview.Router.
+type Reuploader interface {
+	IsSupported(mediaURL string) bool
+	Reupload(ctx context.Context, mediaURL string) (preview.Media, error)
+	Refresh(ctx context.Context, mediaURL string) (preview.Media, error)
 }
 
 func (b *Discord) Start() error {
 	dg, _ := discordgo.New("Bot " + b.Token)
 	b.session = dg
 
-	dg.Identify.Intents = discordgo.IntentGuildMessages | discordgo.IntentDirectMessages
+	if b.Store == nil {
+		b.Store, _ = OpenStore("")
+	}
+
+	dg.Identify.Intents = discordgo.IntentGuilds | discordgo.IntentGuildMessages | discordgo.IntentDirectMessages |
+		discordgo.IntentGuildMessageReactions | discordgo.IntentDirectMessageReactions
 
 	dg.SyncEvents = true
 	dg.StateEnabled = false
@@ -42,6 +63,14 @@ func (b *Discord) Start() error {
 	dg.AddHandler(b.readyHandler)
 	dg.AddHandler(b.messageCreateHandler)
 	dg.AddHandler(b.messageUpdate)
+	dg.AddHandler(b.messageDeleteHandler)
+	dg.AddHandler(b.messageDeleteBulkHandler)
+	dg.AddHandler(b.interactionCreateHandler)
+	dg.AddHandler(b.messageReactionAddHandler)
+	dg.AddHandler(b.channelUpdateHandler)
+	dg.AddHandler(b.channelDeleteHandler)
+	dg.AddHandler(b.threadUpdateHandler)
+	dg.AddHandler(b.threadDeleteHandler)
 
 	var err error
 	err = dg.Open()
@@ -58,70 +87,300 @@ func (b *Discord) Close() error {
 
 func (b *Discord) readyHandler(s *discordgo.Session, m *discordgo.Ready) {
 	b.id = m.User.ID
-	if b.lastChannelMessage == nil {
-		b.lastChannelMessage = make(map[string]string)
-	}
+
+	b.registerOnce.Do(func() {
+		if err := b.registerCommands(s, m.Application.ID); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	})
 }
 
 func (b *Discord) messageCreateHandler(s *discordgo.Session, m *discordgo.MessageCreate) {
-	b.lastChannelMessage[m.ChannelID] = m.ID
+	b.lastMessages.Store(m.ChannelID, m.ID)
 
 	if m.Author.ID == b.id {
 		return
 	}
 
-	url := urlPattern.FindString(m.Content)
-	if url == "" {
+	config := b.Store.GuildConfig(m.GuildID)
+	if !b.previewsAutomatically(s, m.Message, config) {
 		return
 	}
 
-	if !b.Reuploader.IsSupported(url) {
+	links := b.findLinks(m.Content, config)
+	if len(links) == 0 {
 		return
 	}
 
 	ctx := context.Background()
-	go b.replyToMessage(ctx, s, m, url)
+	go b.handleMessage(ctx, s, m.Message, links)
+}
+
+// handleMessage replies to a new message, with the progress and failure
+// feedback its guild asked for.
+func (b *Discord) handleMessage(ctx context.Context, s *discordgo.Session, m *discordgo.Message, links []linkPreview) {
+	if !b.startReplying(m.ID) {
+		return
+	}
+	defer b.doneReplying(m.ID)
+
+	config := b.Store.GuildConfig(m.GuildID)
+
+	done := showProgress(s, m, config.Progress)
+	err := b.replyToMessage(ctx, s, m, links, true)
+	done(err)
+
+	if err != nil && config.FailureReplies {
+		_ = sendFailureReply(s, m, err)
+	}
 }
 
-func (b *Discord) replyToMessage(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, url string) {
+const (
+	// maxLinksPerMessage caps how many links of one message are previewed.
+	maxLinksPerMessage = 5
+	// maxConcurrentReuploads caps how many of them are reuploaded at once.
+	maxConcurrentReuploads = 3
+	// maxGalleryItems is the most items Discord accepts in one media gallery.
+	maxGalleryItems = 10
+)
+
+// previewsAutomatically reports whether the bot previews the links in m on its
+// own, rather than only when asked with a command.
+func (b *Discord) previewsAutomatically(s *discordgo.Session, m *discordgo.Message, config GuildConfig) bool {
+	return config.Mode != ModeCommand && m.Author != nil &&
+		b.channelEnabled(s, config, m.ChannelID) && !b.ignoreAuthor(m, config)
+}
+
+// startReplying claims messageID for one reply at a time, so a new message,
+// its edits and the message command don't race each other. It reports false
+// when another reply is in progress, and doneReplying releases the claim.
+func (b *Discord) startReplying(messageID string) bool {
+	_, busy := b.replying.LoadOrStore(messageID, true)
+	return !busy
+}
+
+func (b *Discord) doneReplying(messageID string) {
+	b.replying.Delete(messageID)
+}
+
+// ignoreAuthor reports whether m comes from someone the bot should leave alone:
+// users who opted out, members of ignored roles, and unless the guild allows
+// them, bots and webhooks.
+func (b *Discord) ignoreAuthor(m *discordgo.Message, config GuildConfig) bool {
+	if (m.Author.Bot || m.WebhookID != "") && !config.AllowBots {
+		return true
+	}
+	if b.Store.OptedOut(m.Author.ID) {
+		return true
+	}
+	if m.Member != nil {
+		for _, role := range m.Member.Roles {
+			if slices.Contains(config.IgnoredRoles, role) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findLinks returns the distinct supported links in content that config
+// allows, in order.
+func (b *Discord) findLinks(content string, config GuildConfig) []linkPreview {
+	var links []linkPreview
+	for _, link := range scanLinks(content) {
+		url := link.url
+		if slices.ContainsFunc(links, func(p linkPreview) bool { return p.url == url }) ||
+			!config.platformEnabled(url) || !b.Reuploader.IsSupported(url) {
+			continue
+		}
+		links = append(links, linkPreview{url: url, index: len(links), spoiler: link.spoiler})
+		if len(links) == maxLinksPerMessage {
+			break
+		}
+	}
+	return links
+}
+
+// linkPreview is one link of a message and where its media was reuploaded to.
+type linkPreview struct {
+	url        string
+	index      int // position among the links of its message
+	hostedURLs []string
+	embed      *discordgo.MessageEmbed
+	spoiler    bool
+	sensitive  bool // the platform marked the media as nsfw
+}
+
+// replyToMessage reuploads the links found in m and replies with their media.
+// It fails only when none of them could be reuploaded or the reply failed.
+// The embeds of m are hidden as configured only when mayHideEmbeds is set.
+func (b *Discord) replyToMessage(ctx context.Context, s *discordgo.Session, m *discordgo.Message, links []linkPreview, mayHideEmbeds bool) (err error) {
+	urls := make([]string, len(links))
+	for i, link := range links {
+		urls[i] = link.url
+	}
+
 	ctx, span := tracer.Start(ctx, "discord_reply", trace.WithAttributes(
 		attribute.String("guild_id", m.GuildID),
 		attribute.String("channel_id", m.ChannelID),
 		attribute.String("message_id", m.ID),
-		attribute.String("author_username", m.Author.Username),
+		attribute.StringSlice("urls", urls),
 	))
-	defer span.End()
+	defer tr.End(span, &err)
 
-	embedCh := b.waitForEmbed(ctx, m)
+	ctx = preview.WithTenant(ctx, preview.Tenant{GuildID: m.GuildID})
+	embedCh := b.waitForEmbeds(ctx, m, len(links))
 
-	hostedURLs, err := b.Reuploader.Reupload(ctx, url)
+	config := b.Store.GuildConfig(m.GuildID)
+	previews, err := b.reuploadAll(ctx, links, b.Reuploader.Reupload)
+	previews, nsfwErr := b.applyNSFWPolicy(s, config, m.ChannelID, previews)
+	err = errors.Join(err, nsfwErr)
+	if len(previews) == 0 {
+		return err
+	}
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(1, err.Error())
-		return
+		span.RecordError(err) // some links failed, reply with the rest
 	}
 
-	reply := b.buildReply(<-embedCh, hostedURLs)
+	embeds := <-embedCh
+	for i := range previews {
+		previews[i].embed = embedFor(embeds, previews[i].url, len(urls))
+	}
 
-	go b.HideEmbeds(m.ChannelID, m.ID)
+	if config.HideEmbeds && mayHideEmbeds {
+		go b.HideEmbeds(m.ChannelID, m.ID)
+	}
 
-	// if there has been a message since then, reply
-	if lastMsg := b.lastChannelMessage[m.ChannelID]; lastMsg != m.ID {
-		reply.Reference = m.Reference()
+	// an edited message reuses the replies it already has
+	existing, _ := b.Store.Reply(m.ID)
+	replyIDs, err := b.sendReplies(s, m, groupPreviews(previews), existing.ReplyIDs, config.Reply)
+	if err != nil {
+		return err
 	}
 
-	_, err = s.ChannelMessageSendComplex(m.ChannelID, reply)
+	authorID := existing.AuthorID
+	if m.Author != nil {
+		authorID = m.Author.ID
+	}
+	err = b.Store.SetReply(m.ID, ReplyRecord{ChannelID: m.ChannelID, AuthorID: authorID, ReplyIDs: replyIDs, URLs: urls})
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(1, err.Error())
+		span.RecordError(err) // the replies went out, they just won't follow edits
+	}
+	return nil
+}
+
+// sendReplies sends one reply per group, editing the existing replies first
+// and deleting any left over. It returns the ids of the replies in use.
+func (b *Discord) sendReplies(s *discordgo.Session, m *discordgo.Message, groups [][]linkPreview, existing []string, style string) ([]string, error) {
+	replyIDs := make([]string, 0, len(groups))
+	for i, group := range groups {
+		reply := b.buildReply(m.ID, group)
+
+		if i < len(existing) {
+			_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+				ID:              existing[i],
+				Channel:         m.ChannelID,
+				Components:      &reply.Components,
+				Flags:           reply.Flags,
+				AllowedMentions: reply.AllowedMentions,
+			})
+			if err != nil {
+				return replyIDs, fmt.Errorf("editing reply: %w", err)
+			}
+			replyIDs = append(replyIDs, existing[i])
+			continue
+		}
+
+		switch style {
+		case ReplyAlways:
+			reply.Reference = m.Reference()
+		case ReplyMessage:
+		default:
+			// if there has been a message since then, reply
+			if lastMsg, _ := b.lastMessages.Load(m.ChannelID); lastMsg != m.ID {
+				reply.Reference = m.Reference()
+			}
+		}
+
+		sent, err := s.ChannelMessageSendComplex(m.ChannelID, reply)
+		if err != nil {
+			return replyIDs, fmt.Errorf("sending reply: %w", err)
+		}
+		replyIDs = append(replyIDs, sent.ID)
 	}
+
+	for _, id := range existing[min(len(groups), len(existing)):] {
+		_ = s.ChannelMessageDelete(m.ChannelID, id)
+	}
+	return replyIDs, nil
 }
 
-func (b *Discord) waitForEmbed(ctx context.Context, mc *discordgo.MessageCreate) <-chan *discordgo.MessageEmbed {
-	ret := make(chan *discordgo.MessageEmbed, 1)
+// reuploadAll runs reupload for links concurrently and returns the ones that
+// worked, in their original order, along with the errors of the others.
+func (b *Discord) reuploadAll(ctx context.Context, links []linkPreview, reupload func(context.Context, string) (preview.Media, error)) ([]linkPreview, error) {
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, maxConcurrentReuploads)
+		results = slices.Clone(links)
+		errs    = make([]error, len(links))
+	)
+	for i := range results {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			media, err := reupload(ctx, results[i].url)
+			results[i].hostedURLs, results[i].sensitive, errs[i] = media.URLs, media.Sensitive, err
+		})
+	}
+	wg.Wait()
+
+	results = slices.DeleteFunc(results, func(p linkPreview) bool {
+		return len(p.hostedURLs) == 0
+	})
+	return results, errors.Join(errs...)
+}
+
+// groupPreviews combines every preview into one reply unless their media
+// wouldn't fit in a single gallery, in which case each link gets its own.
+func groupPreviews(previews []linkPreview) [][]linkPreview {
+	total := 0
+	for _, p := range previews {
+		total += len(p.hostedURLs)
+	}
+	if total <= maxGalleryItems {
+		return [][]linkPreview{previews}
+	}
 
-	if len(mc.Embeds) > 0 {
-		ret <- mc.Embeds[0]
+	groups := make([][]linkPreview, len(previews))
+	for i := range previews {
+		groups[i] = previews[i : i+1]
+	}
+	return groups
+}
+
+// embedFor finds the embed Discord generated for url. With a single link the
+// first embed is used even if its url differs, e.g. after a redirect.
+func embedFor(embeds []*discordgo.MessageEmbed, url string, links int) *discordgo.MessageEmbed {
+	for _, embed := range embeds {
+		if strings.TrimSuffix(embed.URL, "/") == strings.TrimSuffix(url, "/") {
+			return embed
+		}
+	}
+	if links == 1 && len(embeds) > 0 {
+		return embeds[0]
+	}
+	return nil
+}
+
+// waitForEmbeds waits up to a few seconds for Discord to generate embeds for
+// the links in mc, returning early once there are n of them.
+func (b *Discord) waitForEmbeds(ctx context.Context, mc *discordgo.Message, n int) <-chan []*discordgo.MessageEmbed {
+	ret := make(chan []*discordgo.MessageEmbed, 1)
+
+	// older messages already have every embed they're going to get
+	if len(mc.Embeds) >= n || time.Since(mc.Timestamp) > time.Minute {
+		ret <- mc.Embeds
 		close(ret)
 		return ret
 	}
@@ -133,44 +392,92 @@ func (b *Discord) waitForEmbed(ctx context.Context, mc *discordgo.MessageCreate)
 		defer close(ret)
 		ctx, cancel := context.WithTimeout(ctx, time.Second*3)
 		defer cancel()
-		removeHandler := b.session.AddHandler(func(s *discordgo.Session, mu *discordgo.MessageUpdate) {
-			if mu.ID != mc.ID || len(mu.Embeds) == 0 {
+
+		var (
+			mu     sync.Mutex
+			embeds = mc.Embeds
+		)
+		removeHandler := b.session.AddHandler(func(s *discordgo.Session, update *discordgo.MessageUpdate) {
+			if update.ID != mc.ID || len(update.Embeds) == 0 {
 				return
 			}
-			select {
-			case <-ctx.Done():
-				return
-			case ret <- mu.Embeds[0]:
+			mu.Lock()
+			embeds = update.Embeds
+			mu.Unlock()
+			if len(update.Embeds) >= n {
 				cancel()
 			}
 		})
 		defer removeHandler()
 		<-ctx.Done()
+
+		mu.Lock()
+		ret <- embeds
+		mu.Unlock()
 	}()
 
 	return ret
 }
 
-func (b *Discord) buildReply(embed *discordgo.MessageEmbed, hostedURLs []string) *discordgo.MessageSend {
-	content := formatEmbedAsText(embed)
-
-	galleryItems := make([]discordgo.MediaGalleryItem, len(hostedURLs))
-	for i, hostedURL := range hostedURLs {
-		galleryItems[i].Media = discordgo.UnfurledMediaItem{
-			URL: hostedURL,
+// buildReply lays out the media of previews, followed by buttons to manage the
+// reply that point back at sourceID.
+func (b *Discord) buildReply(sourceID string, previews []linkPreview) *discordgo.MessageSend {
+	var (
+		lines        []string
+		galleryItems []discordgo.MediaGalleryItem
+		audioLinks   []string
+	)
+	for _, p := range previews {
+		if line := formatEmbedAsText(p.embed); line != "." {
+			lines = append(lines, line)
+		}
+		for _, hostedURL := range p.hostedURLs {
+			// galleries only show images and video, so audio is linked instead
+			if name, ok := audioName(hostedURL); ok {
+				link := fmt.Sprintf("🔊 [%s](%s)", name, hostedURL)
+				if p.spoiler {
+					link = "||" + link + "||"
+				}
+				audioLinks = append(audioLinks, link)
+				continue
+			}
+			galleryItems = append(galleryItems, discordgo.MediaGalleryItem{
+				Media:   discordgo.UnfurledMediaItem{URL: hostedURL},
+				Spoiler: p.spoiler,
+			})
 		}
 	}
 
-	messageSend := &discordgo.MessageSend{
-		Components: []discordgo.MessageComponent{
-			discordgo.TextDisplay{
-				Content: content,
-			},
-			discordgo.MediaGallery{
-				Items: galleryItems,
-			},
+	content := "."
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n")
+	}
+
+	components := []discordgo.MessageComponent{
+		discordgo.TextDisplay{
+			Content: content,
 		},
-		Flags: discordgo.MessageFlagsIsComponentsV2,
+	}
+	// a single link can have more media than fits in one gallery
+	for chunk := range slices.Chunk(galleryItems, maxGalleryItems) {
+		components = append(components, discordgo.MediaGallery{
+			Items: chunk,
+		})
+	}
+	if len(audioLinks) > 0 {
+		components = append(components, discordgo.TextDisplay{
+			Content: strings.Join(audioLinks, "\n"),
+		})
+	}
+	for row := range slices.Chunk(replyButtons(sourceID, previews), maxRowButtons) {
+		components = append(components, discordgo.ActionsRow{
+			Components: row,
+		})
+	}
+
+	messageSend := &discordgo.MessageSend{
+		Components: components,
+		Flags:      discordgo.MessageFlagsIsComponentsV2,
 		AllowedMentions: &discordgo.MessageAllowedMentions{
 			Parse:       []discordgo.AllowedMentionType{},
 			RepliedUser: true,
@@ -180,9 +487,91 @@ func (b *Discord) buildReply(embed *discordgo.MessageEmbed, hostedURLs []string)
 	return messageSend
 }
 
+// audioName returns the file name of hostedURL if it is an audio file.
+func audioName(hostedURL string) (string, bool) {
+	u, err := url.Parse(hostedURL)
+	if err != nil {
+		return "", false
+	}
+	name := path.Base(u.Path)
+	return name, strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "audio/")
+}
+
+// messageUpdate brings the replies of an edited message in line with its links.
+// A message without replies is handled like a new one once the edit adds links.
 func (b *Discord) messageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
-	if updateCh, ok := b.inFlightMessages[m.ID]; ok {
-		updateCh <- m.Message
+	// updates without an edit timestamp are Discord adding embeds
+	if m.EditedTimestamp == nil {
+		return
+	}
+	config := b.Store.GuildConfig(m.GuildID)
+	record, ok := b.Store.Reply(m.ID)
+	if !ok {
+		b.messageEditedIn(s, m.Message, config)
+		return
+	}
+
+	links := b.findLinks(m.Content, config)
+	urls := make([]string, len(links))
+	for i, link := range links {
+		urls[i] = link.url
+	}
+	if slices.Equal(urls, record.URLs) {
+		return
+	}
+
+	if len(links) == 0 {
+		b.deleteReplies(s, m.ID)
+		return
+	}
+	if m.Author.ID == b.id || !b.previewsAutomatically(s, m.Message, config) {
+		return
+	}
+
+	go func() {
+		// an edit during a reply is left to that reply
+		if !b.startReplying(m.ID) {
+			return
+		}
+		defer b.doneReplying(m.ID)
+		_ = b.replyToMessage(context.Background(), s, m.Message, links, true)
+	}()
+}
+
+// messageEditedIn previews the links an edit added to a message the bot hasn't
+// replied to, under the same rules as a new message. Messages that are still
+// being replied to are left to that reply.
+func (b *Discord) messageEditedIn(s *discordgo.Session, m *discordgo.Message, config GuildConfig) {
+	if m.Author == nil || m.Author.ID == b.id || !b.previewsAutomatically(s, m, config) {
+		return
+	}
+
+	links := b.findLinks(m.Content, config)
+	if len(links) == 0 {
+		return
+	}
+
+	go b.handleMessage(context.Background(), s, m, links)
+}
+
+func (b *Discord) messageDeleteHandler(s *discordgo.Session, m *discordgo.MessageDelete) {
+	b.deleteReplies(s, m.ID)
+}
+
+func (b *Discord) messageDeleteBulkHandler(s *discordgo.Session, m *discordgo.MessageDeleteBulk) {
+	for _, id := range m.Messages {
+		b.deleteReplies(s, id)
+	}
+}
+
+// deleteReplies deletes the replies sent for sourceID, if any.
+func (b *Discord) deleteReplies(s *discordgo.Session, sourceID string) {
+	record, ok, _ := b.Store.DeleteReply(sourceID)
+	if !ok {
+		return
+	}
+	for _, id := range record.ReplyIDs {
+		_ = s.ChannelMessageDelete(record.ChannelID, id)
 	}
 }
 
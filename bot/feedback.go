@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/robertkozin/discord-video-preview-bot/preview"
+)
+
+const (
+	// progressDelay keeps quick reuploads, e.g. of links seen before, from
+	// flashing a progress indicator.
+	progressDelay = 2 * time.Second
+	// typingInterval renews the typing indicator before Discord drops it.
+	typingInterval = 8 * time.Second
+
+	progressEmoji = "⏳"
+	successEmoji  = "✅"
+	failureEmoji  = "⚠️"
+)
+
+// showProgress starts the progress indicator mode on m once
+// progressDelay has passed. The returned func stops it and, for reactions,
+// marks the outcome.
+func showProgress(s *discordgo.Session, m *discordgo.Message, mode string) func(err error) {
+	if mode == ProgressOff {
+		return func(error) {}
+	}
+
+	var (
+		mu      sync.Mutex
+		started bool
+		stop    = make(chan struct{})
+	)
+	timer := time.AfterFunc(progressDelay, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		started = true
+
+		switch mode {
+		case ProgressReaction:
+			_ = s.MessageReactionAdd(m.ChannelID, m.ID, progressEmoji)
+		case ProgressTyping:
+			go func() {
+				ticker := time.NewTicker(typingInterval)
+				defer ticker.Stop()
+				for {
+					_ = s.ChannelTyping(m.ChannelID)
+					select {
+					case <-stop:
+						return
+					case <-ticker.C:
+					}
+				}
+			}()
+		}
+	})
+
+	return func(err error) {
+		timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+		close(stop)
+
+		if mode != ProgressReaction {
+			return
+		}
+		if started {
+			_ = s.MessageReactionRemove(m.ChannelID, m.ID, progressEmoji, "@me")
+		}
+		switch {
+		case err != nil:
+			_ = s.MessageReactionAdd(m.ChannelID, m.ID, failureEmoji)
+		case started:
+			// fast successes speak for themselves
+			_ = s.MessageReactionAdd(m.ChannelID, m.ID, successEmoji)
+		}
+	}
+}
+
+// failureMessage explains err in a sentence fit for a chat message.
+func failureMessage(err error) string {
+	switch {
+	case errors.Is(err, preview.ErrMediaTooLarge):
+		return "That media is too large for me to rehost."
+	case errors.Is(err, preview.ErrMediaUnavailable):
+		return "That post is private or no longer available."
+	case errors.Is(err, preview.ErrLinkNotSupported), errors.Is(err, preview.ErrMediaTypeNotAllowed):
+		return "I can't preview that kind of link."
+	case errors.Is(err, errNSFWSkipped):
+		return "That media is marked as NSFW, so I only preview it in age-restricted channels."
+	case errors.Is(err, preview.ErrUpstreamUnavailable):
+		return "The site isn't responding right now, try again later."
+	default:
+		return "Sorry, I couldn't get the media from that link."
+	}
+}
+
+// sendFailureReply tells the author of m why their links couldn't be previewed.
+func sendFailureReply(s *discordgo.Session, m *discordgo.Message, err error) error {
+	_, err = s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Content:   failureMessage(err),
+		Reference: m.Reference(),
+		Flags:     discordgo.MessageFlagsSuppressNotifications,
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+	return err
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// errNSFWSkipped is returned when every link of a message was left out
+// because of the guild's NSFW policy.
+var errNSFWSkipped = errors.New("sensitive media skipped")
+
+// channelNSFW reports whether channelID is age restricted. Threads follow the
+// channel they were started in. Channels that can't be looked up count as not
+// age restricted.
+func (b *Discord) channelNSFW(s *discordgo.Session, channelID string) bool {
+	info, ok := b.channel(s, channelID)
+	if !ok {
+		return false
+	}
+	if !info.thread {
+		return info.nsfw
+	}
+	parent, _ := b.channel(s, info.parentID)
+	return parent.nsfw
+}
+
+// applyNSFWPolicy applies config's NSFW policy to the sensitive previews about
+// to be sent in channelID. Age-restricted channels get them as they are.
+func (b *Discord) applyNSFWPolicy(s *discordgo.Session, config GuildConfig, channelID string, previews []linkPreview) ([]linkPreview, error) {
+	if config.NSFW == NSFWAllow || !slices.ContainsFunc(previews, func(p linkPreview) bool { return p.sensitive }) {
+		return previews, nil
+	}
+	if b.channelNSFW(s, channelID) {
+		return previews, nil
+	}
+
+	if config.NSFW == NSFWSkip {
+		n := len(previews)
+		previews = slices.DeleteFunc(previews, func(p linkPreview) bool { return p.sensitive })
+		if len(previews) < n {
+			return previews, errNSFWSkipped
+		}
+		return previews, nil
+	}
+
+	for i := range previews {
+		if previews[i].sensitive {
+			previews[i].spoiler = true
+		}
+	}
+	return previews, nil
+}
@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// platforms maps the names guilds can disable to the hosts they cover.
+var platforms = []struct {
+	name  string
+	hosts []string
+}{
+	{"tiktok", []string{"tiktok.com", "vm.tiktok.com"}},
+	{"instagram", []string{"instagram.com"}},
+	{"twitter", []string{"twitter.com", "x.com", "t.co"}},
+	{"bluesky", []string{"bsky.app"}},
+	{"twitch", []string{"twitch.tv"}},
+	{"youtube", []string{"youtube.com", "youtu.be"}},
+	{"reddit", []string{"reddit.com", "old.reddit.com", "redd.it", "v.redd.it"}},
+}
+
+// platformOf names the platform of link, "" for other sites.
+func platformOf(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	for _, p := range platforms {
+		if slices.Contains(p.hosts, host) {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// platformEnabled reports whether config allows previewing link.
+func (c GuildConfig) platformEnabled(link string) bool {
+	platform := platformOf(link)
+	return platform == "" || !slices.Contains(c.DisabledPlatforms, platform)
+}
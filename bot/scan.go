@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"strings"
+)
+
+// scannedLink is a link found in a message and whether it was spoilered.
+type scannedLink struct {
+	url     string
+	spoiler bool
+}
+
+// scanLinks finds the links in a message the way Discord renders it. Links in
+// code blocks or inline code aren't links, links wrapped in <...> were
+// deliberately suppressed by the author, and links between || are spoilers.
+// Trailing punctuation and markdown are not part of the link.
+func scanLinks(content string) []scannedLink {
+	var (
+		links   []scannedLink
+		spoiler bool
+	)
+	for i := 0; i < len(content); {
+		rest := content[i:]
+		switch {
+		case rest[0] == '\\':
+			i = min(i+2, len(content)) // escaped markdown, e.g. \|| or \`
+		case strings.HasPrefix(rest, "```"):
+			end := strings.Index(rest[3:], "```")
+			if end < 0 {
+				return links // unclosed blocks run to the end
+			}
+			i += 3 + end + 3
+		case rest[0] == '`':
+			ticks := len(rest) - len(strings.TrimLeft(rest, "`"))
+			end := strings.Index(rest[ticks:], strings.Repeat("`", ticks))
+			if end < 0 {
+				i += ticks // unclosed inline code is plain text
+				continue
+			}
+			i += ticks + end + ticks
+		case strings.HasPrefix(rest, "||"):
+			spoiler = !spoiler
+			i += 2
+		case rest[0] == '<' && hasLinkPrefix(rest[1:]):
+			end := strings.IndexAny(rest, "> \t\n")
+			if end > 0 && rest[end] == '>' {
+				i += end + 1 // suppressed
+				continue
+			}
+			i++
+		case hasLinkPrefix(rest):
+			raw := rest[:linkEnd(rest)]
+			if url := trimLink(raw); url != "" {
+				links = append(links, scannedLink{url: url, spoiler: spoiler})
+			}
+			i += len(raw)
+		default:
+			i++
+		}
+	}
+	return links
+}
+
+func hasLinkPrefix(s string) bool {
+	return strings.HasPrefix(s, "https://")
+}
+
+// linkEnd finds where a link stops: at whitespace, or at markup Discord
+// parses even inside a link, like the || closing a spoiler or an escape.
+func linkEnd(s string) int {
+	for j := 0; j < len(s); j++ {
+		switch s[j] {
+		case ' ', '\t', '\n', '\r', '`', '<', '\\':
+			return j
+		case '|':
+			if strings.HasPrefix(s[j:], "||") {
+				return j
+			}
+		}
+	}
+	return len(s)
+}
+
+// trimLink strips trailing punctuation and markdown from a link, keeping
+// closing brackets that have a matching opening bracket in the link, as in
+// https://en.wikipedia.org/wiki/Go_(programming_language).
+func trimLink(link string) string {
+	for len(link) > len("https://") {
+		last := link[len(link)-1]
+		switch last {
+		case '.', ',', ';', ':', '!', '?', '\'', '"', '*', '_', '~', '>':
+		case ')':
+			if strings.Count(link, "(") >= strings.Count(link, ")") {
+				return link
+			}
+		case ']':
+			if strings.Count(link, "[") >= strings.Count(link, "]") {
+				return link
+			}
+		default:
+			return link
+		}
+		link = link[:len(link)-1]
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestScanLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []scannedLink
+	}{
+		{"plain", "look https://x.com/a/status/1 wow", []scannedLink{{url: "https://x.com/a/status/1"}}},
+		{"code block", "```\nhttps://x.com/a\n``` https://x.com/b", []scannedLink{{url: "https://x.com/b"}}},
+		{"unclosed code block", "https://x.com/a ```https://x.com/b", []scannedLink{{url: "https://x.com/a"}}},
+		{"inline code", "`https://x.com/a` https://x.com/b", []scannedLink{{url: "https://x.com/b"}}},
+		{"double backtick code", "``a ` https://x.com/a`` https://x.com/b", []scannedLink{{url: "https://x.com/b"}}},
+		{"unclosed inline code", "`https://x.com/a", []scannedLink{{url: "https://x.com/a"}}},
+		{"escaped backtick", "\\`https://x.com/a\\`", []scannedLink{{url: "https://x.com/a"}}},
+		{"escaped spoiler", "\\||https://x.com/a", []scannedLink{{url: "https://x.com/a"}}},
+		{"trailing backslash", "https://x.com/a \\", []scannedLink{{url: "https://x.com/a"}}},
+		{"suppressed", "<https://x.com/a> https://x.com/b", []scannedLink{{url: "https://x.com/b"}}},
+		{"unclosed angle bracket", "<https://x.com/a", []scannedLink{{url: "https://x.com/a"}}},
+		{"spoiler", "||https://x.com/a|| https://x.com/b", []scannedLink{{url: "https://x.com/a", spoiler: true}, {url: "https://x.com/b"}}},
+		{"spoiler with spaces", "|| https://x.com/a ||", []scannedLink{{url: "https://x.com/a", spoiler: true}}},
+		{"trailing punctuation", "see https://x.com/a/status/1.", []scannedLink{{url: "https://x.com/a/status/1"}}},
+		{"trailing markdown", "**https://x.com/a**", []scannedLink{{url: "https://x.com/a"}}},
+		{"parenthesized", "(https://x.com/a)", []scannedLink{{url: "https://x.com/a"}}},
+		{"balanced parens", "https://en.wikipedia.org/wiki/Go_(programming_language)", []scannedLink{{url: "https://en.wikipedia.org/wiki/Go_(programming_language)"}}},
+		{"balanced parens in parens", "(https://en.wikipedia.org/wiki/Go_(lang))", []scannedLink{{url: "https://en.wikipedia.org/wiki/Go_(lang)"}}},
+		{"bare scheme", "https://", nil},
+		{"not https", "http://x.com/a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scanLinks(tt.content); !slices.Equal(got, tt.want) {
+				t.Errorf("scanLinks(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
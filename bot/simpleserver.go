@@ -3,7 +3,10 @@ package bot
 import (
 	"fmt"
 	"html/template"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
 	"strings"
 
 	"github.com/robertkozin/discord-video-preview-bot/preview"
@@ -34,12 +37,18 @@ var page = `<!doctype html>
 		<h2>Result</h2>
 		{{range .URLs}}
 			<p><a href="{{.}}" target="_blank">{{.}}</a></p>
-			{{if or (hasSuffix . ".mp4")}}
+			{{$type := mediaType .}}
+			{{if hasPrefix $type "video/"}}
 				<video controls width="400">
-					<source src="{{.}}" type="video/mp4">
+					<source src="{{.}}" type="{{$type}}">
 					Your browser does not support the video tag.
 				</video>
-			{{else if or (hasSuffix . ".jpg") (hasSuffix . ".jpeg") (hasSuffix . ".png")}}
+			{{else if hasPrefix $type "audio/"}}
+				<audio controls>
+					<source src="{{.}}" type="{{$type}}">
+					Your browser does not support the audio tag.
+				</audio>
+			{{else if hasPrefix $type "image/"}}
 				<img src="{{.}}" alt="Media" style="max-width: 400px; height: auto;">
 			{{end}}
 		{{end}}
@@ -56,12 +65,16 @@ type pageData struct {
 var tmpl = template.Must(
 	template.New("page").
 		Funcs(template.FuncMap{
-			"hasSuffix": strings.HasSuffix,
+			"hasPrefix": strings.HasPrefix,
+			"mediaType": mediaType,
 		}).
 		Parse(page),
 )
 
-func SimpleServer(reup *preview.Reuploader) http.Handler {
+// SimpleServer serves the tester page. Requests with an X-API-Key header are
+// routed like the bot routes guilds, see preview.Router, and keys the router
+// doesn't know are rejected rather than falling back to the default route.
+func SimpleServer(router *preview.Router) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
@@ -74,23 +87,40 @@ func SimpleServer(reup *preview.Reuploader) http.Handler {
 		case "GET":
 			err := tmpl.Execute(w, data)
 			if err != nil {
-				fmt.Printf("template execute error: %w\n", err)
+				fmt.Printf("template execute error: %v\n", err)
 			}
 		case "POST":
+			apiKey := r.Header.Get("X-API-Key")
+			if apiKey != "" && !router.HasAPIKey(apiKey) {
+				http.Error(w, "unknown api key", http.StatusUnauthorized)
+				return
+			}
+
 			data.Input = r.FormValue("input")
-			urls, err := reup.Reupload(r.Context(), data.Input)
+			ctx := preview.WithTenant(r.Context(), preview.Tenant{APIKey: apiKey})
+			media, err := router.Reupload(ctx, data.Input)
 			if err != nil {
 				data.Error = err.Error()
 			} else {
-				data.URLs = urls
+				data.URLs = media.URLs
 			}
 
 			err = tmpl.Execute(w, data)
 			if err != nil {
-				fmt.Printf("template execute error: %w", err)
+				fmt.Printf("template execute error: %v", err)
 			}
 		default:
 			http.NotFound(w, r)
 		}
 	})
 }
+
+// mediaType guesses the content type of a hosted file from its extension,
+// ignoring any query string such as a link signature.
+func mediaType(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return mime.TypeByExtension(strings.ToLower(path.Ext(u.Path)))
+}
@@ -0,0 +1,320 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// replyRetention is how long a reply is remembered. Older source messages can
+// still be deleted or edited, the bot just won't follow along anymore.
+const replyRetention = 30 * 24 * time.Hour
+
+// replyFlushDelay is how long reply bookkeeping waits before it is written, so
+// a busy server rewrites the file every few seconds rather than per message.
+const replyFlushDelay = 5 * time.Second
+
+// Store keeps the bot's state in a json file, rewritten atomically. Settings
+// are written right away, replies within replyFlushDelay and on Close. With an
+// empty path it only lives in memory.
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	data  storeData
+	flush *time.Timer // pending save of replies, if any
+}
+
+type storeData struct {
+	// Replies maps source message ids to the replies the bot sent for them.
+	Replies map[string]ReplyRecord `json:"replies"`
+	// Guilds holds settings for guilds that changed them from the defaults.
+	Guilds map[string]GuildConfig `json:"guilds,omitempty"`
+	// OptOuts are users whose messages the bot leaves alone.
+	OptOuts map[string]bool `json:"opt_outs,omitempty"`
+}
+
+// Progress indicators shown on a message while its links are reuploaded.
+const (
+	ProgressReaction = "reaction" // ⏳ while working, then ✅ or ⚠️
+	ProgressTyping   = "typing"
+	ProgressOff      = "off"
+)
+
+// Modes decide which messages the bot looks at.
+const (
+	ModeAuto    = "auto"    // every message in an enabled channel
+	ModeCommand = "command" // only /preview and the message command
+)
+
+// Reply styles decide whether previews are sent as replies.
+const (
+	ReplyAuto    = "auto"    // reply once other messages came in between
+	ReplyAlways  = "reply"   // always reply to the source message
+	ReplyMessage = "message" // never reply, just post
+)
+
+// NSFW policies decide what happens to media the platform marked as adult or
+// age restricted when it's posted outside an age-restricted channel.
+const (
+	NSFWSkip    = "skip"    // don't preview it
+	NSFWSpoiler = "spoiler" // preview it behind a spoiler
+	NSFWAllow   = "allow"   // preview it like anything else
+)
+
+type GuildConfig struct {
+	Mode string `json:"mode"`
+	// Channels limits automatic previews to these channels and categories, all
+	// channels when empty.
+	Channels []string `json:"channels,omitempty"`
+	// DisabledPlatforms are never previewed, see platformOf.
+	DisabledPlatforms []string `json:"disabled_platforms,omitempty"`
+	// IgnoredRoles are roles whose members' messages aren't previewed.
+	IgnoredRoles []string `json:"ignored_roles,omitempty"`
+	// AllowBots previews messages from other bots and webhooks too.
+	AllowBots bool `json:"allow_bots"`
+	// HideEmbeds suppresses the embeds Discord adds to the source message.
+	HideEmbeds bool   `json:"hide_embeds"`
+	Reply      string `json:"reply"`
+
+	// Progress is off unless the guild opts in, see ProgressReaction.
+	Progress string `json:"progress"`
+	// FailureReplies explains in a short reply why a link couldn't be previewed.
+	FailureReplies bool `json:"failure_replies"`
+	// NSFW is the policy for sensitive media outside age-restricted channels.
+	NSFW string `json:"nsfw"`
+}
+
+// UnmarshalJSON fills settings missing from older stores with their defaults.
+func (c *GuildConfig) UnmarshalJSON(b []byte) error {
+	type plain GuildConfig
+	config := plain(defaultGuildConfig())
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	*c = GuildConfig(config)
+	return nil
+}
+
+func defaultGuildConfig() GuildConfig {
+	return GuildConfig{
+		Mode:       ModeAuto,
+		HideEmbeds: true,
+		Reply:      ReplyAuto,
+		Progress:   ProgressOff,
+		NSFW:       NSFWSpoiler,
+	}
+}
+
+type ReplyRecord struct {
+	ChannelID string    `json:"channel_id"`
+	AuthorID  string    `json:"author_id"` // who posted the source message
+	ReplyIDs  []string  `json:"reply_ids"`
+	URLs      []string  `json:"urls"` // links that were previewed, in order
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("reading store: %w", err)
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &s.data); err != nil {
+				return nil, fmt.Errorf("parsing store: %w", err)
+			}
+		}
+	}
+	if s.data.Replies == nil {
+		s.data.Replies = map[string]ReplyRecord{}
+	}
+	if s.data.Guilds == nil {
+		s.data.Guilds = map[string]GuildConfig{}
+	}
+	if s.data.OptOuts == nil {
+		s.data.OptOuts = map[string]bool{}
+	}
+	return s, nil
+}
+
+func (s *Store) Reply(sourceID string) (ReplyRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.data.Replies[sourceID]
+	return record, ok
+}
+
+func (s *Store) SetReply(sourceID string, record ReplyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record.CreatedAt.IsZero() {
+		// edits keep the time of the first reply
+		record.CreatedAt = time.Now().UTC()
+		if old, ok := s.data.Replies[sourceID]; ok {
+			record.CreatedAt = old.CreatedAt
+		}
+	}
+	s.data.Replies[sourceID] = record
+	return s.saveLater()
+}
+
+// ReplySource finds the source message of a reply.
+func (s *Store) ReplySource(replyID string) (string, ReplyRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sourceID, record := range s.data.Replies {
+		if slices.Contains(record.ReplyIDs, replyID) {
+			return sourceID, record, true
+		}
+	}
+	return "", ReplyRecord{}, false
+}
+
+// RemoveReplyMessage forgets one reply of sourceID, and sourceID itself once
+// it has no replies left.
+func (s *Store) RemoveReplyMessage(sourceID, replyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.data.Replies[sourceID]
+	if !ok {
+		return nil
+	}
+	record.ReplyIDs = slices.DeleteFunc(record.ReplyIDs, func(id string) bool { return id == replyID })
+	if len(record.ReplyIDs) == 0 {
+		delete(s.data.Replies, sourceID)
+	} else {
+		s.data.Replies[sourceID] = record
+	}
+	return s.saveLater()
+}
+
+// GuildConfig returns the settings of guildID, the defaults if it has none.
+func (s *Store) GuildConfig(guildID string) GuildConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if config, ok := s.data.Guilds[guildID]; ok {
+		return config
+	}
+	return defaultGuildConfig()
+}
+
+// UpdateGuildConfig applies update to the settings of guildID and saves them.
+func (s *Store) UpdateGuildConfig(guildID string, update func(*GuildConfig)) (GuildConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, ok := s.data.Guilds[guildID]
+	if !ok {
+		config = defaultGuildConfig()
+	}
+	update(&config)
+	s.data.Guilds[guildID] = config
+	return config, s.save()
+}
+
+func (s *Store) OptedOut(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.OptOuts[userID]
+}
+
+// ToggleOptOut flips whether userID opted out and returns the new state.
+func (s *Store) ToggleOptOut(userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	optedOut := !s.data.OptOuts[userID]
+	if optedOut {
+		s.data.OptOuts[userID] = true
+	} else {
+		delete(s.data.OptOuts, userID)
+	}
+	return optedOut, s.save()
+}
+
+// DeleteReply forgets sourceID and returns what was recorded for it.
+func (s *Store) DeleteReply(sourceID string) (ReplyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.data.Replies[sourceID]
+	if !ok {
+		return record, false, nil
+	}
+	delete(s.data.Replies, sourceID)
+	return record, true, s.saveLater()
+}
+
+// Close writes any replies that are still waiting to be saved.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flush == nil {
+		return nil
+	}
+	return s.save()
+}
+
+// saveLater saves the store within replyFlushDelay. It always returns nil, the
+// error return matches save for its callers. The caller must hold mu.
+func (s *Store) saveLater() error {
+	if s.path == "" {
+		return s.save()
+	}
+	if s.flush == nil {
+		s.flush = time.AfterFunc(replyFlushDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if err := s.save(); err != nil {
+				fmt.Printf("saving store: %v\n", err)
+			}
+		})
+	}
+	return nil
+}
+
+// save writes the store to disk, dropping replies past replyRetention. The
+// caller must hold mu.
+func (s *Store) save() error {
+	if s.flush != nil {
+		s.flush.Stop()
+		s.flush = nil
+	}
+
+	for id, record := range s.data.Replies {
+		if time.Since(record.CreatedAt) > replyRetention {
+			delete(s.data.Replies, id)
+		}
+	}
+
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(s.data)
+	if err != nil {
+		return fmt.Errorf("marshaling store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("replacing store: %w", err)
+	}
+	return nil
+}
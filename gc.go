@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/robertkozin/discord-video-preview-bot/preview"
+)
+
+// runGC expires old manifests in DESTINATION and deletes unreferenced files.
+func runGC(ctx context.Context, argv []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dest := flags.String("dest", "", "destination url (defaults to DESTINATION)")
+	maxAge := flags.Duration("max-age", 0, "expire manifests older than this (defaults to RETENTION)")
+	grace := flags.Duration("grace", time.Hour, "keep unreferenced files newer than this")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+
+	args, err := parseArgs()
+	if err != nil {
+		return fmt.Errorf("parsing args: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	destURL := args.Destination.String()
+	if *dest != "" {
+		destURL = *dest
+	}
+	d, err := openDestination(ctx, destURL)
+	if err != nil {
+		return fmt.Errorf("opening destination: %w", err)
+	}
+	defer d.Close()
+
+	opts := preview.CollectOptions{MaxAge: args.Retention, GracePeriod: *grace}
+	if *maxAge != 0 {
+		opts.MaxAge = *maxAge
+	}
+
+	stats, err := preview.Collect(ctx, d, opts)
+	fmt.Println(stats)
+	return err
+}
+
+func collectEvery(ctx context.Context, dest preview.Destination, interval time.Duration, opts preview.CollectOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := preview.Collect(ctx, dest, opts)
+		if err != nil {
+			fmt.Printf("collecting %s: %v\n", dest, err)
+			continue
+		}
+		fmt.Printf("collected %s: %s\n", dest, stats)
+	}
+}
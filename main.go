@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/robertkozin/discord-video-preview-bot/bot"
@@ -18,13 +19,46 @@ import (
 type Args struct {
 	Destination  *url.URL   `env:"DESTINATION" envDefault:"rclone+webdav://rclone_webdav:8080"`
 	Extractors   []*url.URL `env:"EXTRACTORS" envDefault:"cobalt://localhost:9000?insecure=1"`
-	PublicURL    *url.URL   `env:"PUBLIC_URL" envDefault:"http://localhost:8080"`
+	PublicURL    *url.URL   `env:"PUBLIC_URL"`
 	DiscordToken string     `env:"DISCORD_TOKEN"`
+
+	// Proxy serves the destination's files from our own host, e.g.
+	// http://0.0.0.0:8090?sign_key=env:LINK_SIGNING_KEY (see preview.ServeFiles).
+	// Routed destinations name their own, see routesConfig.
+	Proxy          *url.URL      `env:"PROXY"`
+	LinkSigningKey string        `env:"LINK_SIGNING_KEY"`
+	LinkTTL        time.Duration `env:"LINK_TTL" envDefault:"8760h"`
+	WebLinkTTL     time.Duration `env:"WEB_LINK_TTL" envDefault:"1h"`
+
+	ContentAddressed bool `env:"CONTENT_ADDRESSED"`
+	// MediaPolicy overrides preview.DefaultMediaPolicy, e.g. "video/mp4=100MB,image/*=10MB".
+	// The destination's media_policy option is applied on top.
+	MediaPolicy string `env:"MEDIA_POLICY"`
+	// Retention expires manifests older than this and deletes the files only
+	// they referenced, checked hourly. Zero keeps everything.
+	Retention time.Duration `env:"RETENTION"`
+
+	// RoutesConfig is a json file sending some guilds or api keys to their own
+	// destination, see routesConfig.
+	RoutesConfig string `env:"ROUTES_CONFIG"`
+
+	// StorePath is where the bot remembers its replies so it can clean them up
+	// when the source message is edited or deleted.
+	StorePath string `env:"STORE_PATH" envDefault:"bot-store.json"`
 }
 
 func main() {
 	ctx := context.Background()
 
+	if len(os.Args) > 1 {
+		err := runCommand(ctx, os.Args[1], os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error running %s: %+v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	args, err := parseArgs()
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "error parsing startup args: %+v\n", err)
@@ -38,6 +72,19 @@ func main() {
 	}
 }
 
+func runCommand(ctx context.Context, name string, argv []string) error {
+	switch name {
+	case "migrate":
+		return runMigrate(ctx, argv)
+	case "scrub":
+		return runScrub(ctx, argv)
+	case "gc":
+		return runGC(ctx, argv)
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
 func parseArgs() (args Args, err error) {
 	err = env.Parse(&args)
 	if err != nil {
@@ -67,38 +114,91 @@ func run(ctx context.Context, args Args) error {
 
 	defer tr.Shutdown()
 
-	extractors := make([]preview.Extractor, len(args.Extractors))
-	for i, ex := range args.Extractors {
-		extractors[i], err = preview.NewExtractor(ex)
-		if err != nil {
-			return fmt.Errorf("creating extractor: %w", err)
-		}
+	extractors, err := newExtractors(args)
+	if err != nil {
+		return err
 	}
 
 	dest, err := preview.NewDestination(ctx, args.Destination)
 	if err != nil {
 		return fmt.Errorf("creating destination: %w", err)
 	}
+	defer dest.Close()
+
+	publicURL := "http://localhost:8080"
+	if args.PublicURL != nil {
+		publicURL = args.PublicURL.String()
+	} else if destURL, ok := preview.DestinationPublicURL(dest); ok {
+		publicURL = destURL
+	}
+
+	policy, err := newMediaPolicy(args, args.Destination)
+	if err != nil {
+		return err
+	}
 
 	reuploader := preview.Reuploader{
-		PublicURL:   args.PublicURL.String(),
-		Extractors:  extractors,
-		Destination: dest,
+		PublicURL:        publicURL,
+		Extractors:       extractors,
+		Destination:      dest,
+		Policy:           policy,
+		ContentAddressed: args.ContentAddressed,
+	}
+
+	if args.LinkSigningKey != "" {
+		reuploader.Signer, err = preview.NewURLSigner(args.LinkSigningKey)
+		if err != nil {
+			return fmt.Errorf("creating link signer: %w", err)
+		}
+	}
+
+	reuploader.LinkTTL = args.WebLinkTTL
+	if args.DiscordToken != "" {
+		reuploader.LinkTTL = args.LinkTTL
+	}
+
+	router, err := newRouter(ctx, args, args.RoutesConfig, &reuploader)
+	if err != nil {
+		return err
+	}
+	defer router.Close()
+
+	if args.Retention > 0 {
+		for _, dest := range router.Destinations() {
+			go collectEvery(ctx, dest, time.Hour, preview.CollectOptions{
+				MaxAge:      args.Retention,
+				GracePeriod: time.Hour,
+			})
+		}
+	}
+
+	if args.Proxy != nil {
+		proxy, err := preview.ServeFiles(dest, args.Proxy)
+		if err != nil {
+			return fmt.Errorf("starting proxy: %w", err)
+		}
+		defer proxy.Close()
 	}
 
 	if args.DiscordToken != "" {
+		store, err := bot.OpenStore(args.StorePath)
+		if err != nil {
+			return fmt.Errorf("opening store: %w", err)
+		}
+		defer store.Close()
 		bot := &bot.Discord{
 			Token:      args.DiscordToken,
-			Reuploader: reuploader,
+			Reuploader: router.Router,
+			Store:      store,
 		}
-		err := bot.Start()
+		err = bot.Start()
 		if err != nil {
 			return fmt.Errorf("starting discord bot: %w", err)
 		}
 		fmt.Println("discord running")
 		defer bot.Close()
 	} else {
-		handler := bot.SimpleServer(&reuploader)
+		handler := bot.SimpleServer(router.Router)
 		go http.ListenAndServe("localhost:8081", handler)
 	}
 
@@ -107,3 +207,27 @@ func run(ctx context.Context, args Args) error {
 
 	return nil
 }
+
+func newExtractors(args Args) ([]preview.Extractor, error) {
+	var err error
+	extractors := make([]preview.Extractor, len(args.Extractors))
+	for i, ex := range args.Extractors {
+		extractors[i], err = preview.NewExtractor(ex)
+		if err != nil {
+			return nil, fmt.Errorf("creating extractor: %w", err)
+		}
+	}
+	return extractors, nil
+}
+
+func newMediaPolicy(args Args, destination *url.URL) (preview.MediaPolicy, error) {
+	policy := preview.DefaultMediaPolicy
+	if args.MediaPolicy != "" {
+		override, err := preview.ParseMediaPolicy(args.MediaPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing MEDIA_POLICY: %w", err)
+		}
+		policy = policy.Merge(override)
+	}
+	return preview.DestinationMediaPolicy(policy, destination)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/robertkozin/discord-video-preview-bot/preview"
+)
+
+// runMigrate copies every manifest and its files between two destinations:
+//
+//	main migrate -from rclone+webdav://rclone_webdav:8080 -to b2://key:secret@bucket
+func runMigrate(ctx context.Context, argv []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.String("from", "", "source destination url")
+	to := flags.String("to", "", "target destination url")
+	concurrency := flags.Int("concurrency", 4, "manifests to copy at once")
+	verify := flags.Bool("verify", true, "download copied files again and compare checksums")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New("expecting both -from and -to")
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	src, err := openDestination(ctx, *from)
+	if err != nil {
+		return fmt.Errorf("opening source: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := openDestination(ctx, *to)
+	if err != nil {
+		return fmt.Errorf("opening target: %w", err)
+	}
+	defer dst.Close()
+
+	fmt.Printf("migrating from %s to %s\n", src, dst)
+
+	stats := &preview.MigrateStats{}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Println(stats)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = preview.Migrate(ctx, src, dst, preview.MigrateOptions{
+		Concurrency: *concurrency,
+		Verify:      *verify,
+	}, stats)
+	close(done)
+
+	fmt.Println(stats)
+	return err
+}
+
+func openDestination(ctx context.Context, raw string) (preview.Destination, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q as a url: %w", raw, err)
+	}
+	return preview.NewDestination(ctx, u)
+}
@@ -3,37 +3,78 @@ package preview
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/fs"
 	"mime"
 	"net/url"
 	"path/filepath"
+	"strconv"
 
 	blazer "github.com/Backblaze/blazer/b2"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var _ Destination = (*B2Destination)(nil)
 
+// B2Destination stores files in a Backblaze B2 bucket.
+//
+//	b2://keyID:appKey@bucket?chunk_size=100MB&concurrency=4&cache_control=public,max-age=31536000&content_disposition=inline
+//
+// Files larger than chunk_size are sent through the large file api with
+// concurrency parts in flight. Uploads are skipped when the bucket already has
+// a file with the same name and sha1.
 type B2Destination struct {
-	bucket *blazer.Bucket
+	bucket             *blazer.Bucket
+	chunkSize          int
+	concurrency        int
+	cacheControl       string
+	contentDisposition string
 }
 
 func NewB2(ctx context.Context, config *url.URL) (*B2Destination, error) {
 	keyID := config.User.Username()
 	appKey, _ := config.User.Password()
 	bucketName := config.Hostname()
+	query := config.Query()
+
+	dest := &B2Destination{
+		chunkSize:          100 * megaByte,
+		concurrency:        4,
+		cacheControl:       query.Get("cache_control"),
+		contentDisposition: query.Get("content_disposition"),
+	}
+
+	if raw := query.Get("chunk_size"); raw != "" {
+		size, err := parseByteSize(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing chunk_size: %w", err)
+		}
+		if size < 5*megaByte {
+			return nil, fmt.Errorf("expecting chunk_size to be at least 5MB: %s", raw)
+		}
+		dest.chunkSize = int(size)
+	}
+
+	if raw := query.Get("concurrency"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("expecting concurrency to be a positive number: %q", raw)
+		}
+		dest.concurrency = n
+	}
 
 	client, err := blazer.NewClient(ctx, keyID, appKey)
 	if err != nil {
 		return nil, fmt.Errorf("creating blazer/b2 client: %w", err)
 	}
-	bucket, err := client.Bucket(ctx, bucketName)
+	dest.bucket, err = client.Bucket(ctx, bucketName)
 	if err != nil {
 		return nil, fmt.Errorf("getting b2 bucket: %w", err)
 	}
 
-	return &B2Destination{bucket: bucket}, nil
+	return dest, nil
 }
 
 func (b2 *B2Destination) String() string {
@@ -44,6 +85,11 @@ func (b2 *B2Destination) Close() error {
 	return nil
 }
 
+// PublicURL is the bucket's friendly download url, which works for public buckets.
+func (b2 *B2Destination) PublicURL() string {
+	return fmt.Sprintf("%s/file/%s", b2.bucket.BaseURL(), b2.bucket.Name())
+}
+
 func (b2 *B2Destination) Download(ctx context.Context, name string) ([]byte, error) {
 	r := b2.bucket.Object(name).NewReader(ctx)
 	defer r.Close()
@@ -51,7 +97,7 @@ func (b2 *B2Destination) Download(ctx context.Context, name string) ([]byte, err
 	b, err := io.ReadAll(r)
 	if err != nil {
 		if blazer.IsNotExist(err) {
-			return nil, fs.ErrNotExist // TODO what to I do here. io, not found?? yeah think so
+			return nil, notExist(name)
 		}
 		return nil, fmt.Errorf("reading manifest from b2: %w", err)
 	}
@@ -59,20 +105,77 @@ func (b2 *B2Destination) Download(ctx context.Context, name string) ([]byte, err
 	return b, nil
 }
 
+func (b2 *B2Destination) Exists(ctx context.Context, name string) (bool, error) {
+	attrs, err := b2.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		if blazer.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("getting b2 obj attributes: %w", err)
+	}
+	return attrs.Status == blazer.Uploaded, nil
+}
+
+func (b2 *B2Destination) Delete(ctx context.Context, name string) error {
+	err := b2.bucket.Object(name).Delete(ctx)
+	if err != nil {
+		if blazer.IsNotExist(err) {
+			return notExist(name)
+		}
+		return fmt.Errorf("deleting from b2: %w", err)
+	}
+	return nil
+}
+
+func (b2 *B2Destination) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	iter := b2.bucket.List(ctx)
+	for iter.Next() {
+		// listed objects carry the file info from b2_list_file_names, so this
+		// reads it without another request
+		attrs, err := iter.Object().Attrs(ctx)
+		if err != nil {
+			return fmt.Errorf("getting b2 obj attributes: %w", err)
+		}
+		if attrs.Status != blazer.Uploaded {
+			continue
+		}
+		modTime := attrs.LastModified
+		if modTime.IsZero() {
+			modTime = attrs.UploadTimestamp
+		}
+		if err := fn(ObjectInfo{Name: attrs.Name, Size: attrs.Size, ModTime: modTime}); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("listing b2 bucket: %w", err)
+	}
+	return nil
+}
+
 func (b2 *B2Destination) Upload(ctx context.Context, name string, content []byte) error {
+	ctx, span := tracer.Start(ctx, "b2_upload")
+	defer span.End()
+
 	if err := validateSimpleFilename(name); err != nil {
 		return err
 	}
 
 	obj := b2.bucket.Object(name)
-	uploadAttrs := blazer.Attrs{}
+	sum := sha1.Sum(content)
+	uploadAttrs := blazer.Attrs{
+		SHA1: hex.EncodeToString(sum[:]),
+		Info: map[string]string{},
+	}
 
-	// shouldUpload, err := b2.shouldUpload(ctx, obj, name)
-	// if err != nil {
-	// 	return fmt.Errorf("determining whether to upload file to b2: %w", err)
-	// } else if !shouldUpload {
-	// 	return nil
-	// }
+	shouldUpload, err := b2.shouldUpload(ctx, obj, uploadAttrs.SHA1)
+	if err != nil {
+		return fmt.Errorf("determining whether to upload file to b2: %w", err)
+	}
+	span.SetAttributes(attribute.Bool("skipped", !shouldUpload))
+	if !shouldUpload {
+		return nil
+	}
 
 	{
 		ext := filepath.Ext(name)
@@ -86,12 +189,21 @@ func (b2 *B2Destination) Upload(ctx context.Context, name string, content []byte
 		uploadAttrs.ContentType = mimeType
 	}
 
+	// b2 turns these file info keys into response headers on download
+	if b2.cacheControl != "" {
+		uploadAttrs.Info["b2-cache-control"] = b2.cacheControl
+	}
+	if b2.contentDisposition != "" {
+		uploadAttrs.Info["b2-content-disposition"] = mime.FormatMediaType(b2.contentDisposition, map[string]string{"filename": name})
+	}
+
 	writer := obj.NewWriter(ctx, blazer.WithAttrsOption(&uploadAttrs))
-	writer.ChunkSize = MaxMediaSize + 1
+	writer.ChunkSize = b2.chunkSize
+	writer.ConcurrentUploads = b2.concurrency
 	writer.UseFileBuffer = false
 
 	reader := bytes.NewReader(content)
-	_, err := writer.ReadFrom(reader)
+	_, err = writer.ReadFrom(reader)
 	if err != nil {
 		writer.Close()
 		return fmt.Errorf("copying file to b2: %w", err)
@@ -104,30 +216,20 @@ func (b2 *B2Destination) Upload(ctx context.Context, name string, content []byte
 	return nil
 }
 
-// func (b2 *B2Destination) shouldUpload(ctx context.Context, obj *blazer.Object, data []byte) (bool, error) {
-// 	if file.Size == 0 && file.ModTime.IsZero() && file.SHA1 == "" {
-// 		return true, nil
-// 	}
-
-// 	remote, err := obj.Attrs(ctx)
-// 	if err != nil {
-// 		if blazer.IsNotExist(err) {
-// 			return true, nil
-// 		}
-// 		return true, fmt.Errorf("getting b2 obj attributes: %w", err)
-// 	}
-
-// 	if file.SHA1 != "" && remote.SHA1 != "" && remote.SHA1 != "none" {
-// 		return file.SHA1 != remote.SHA1, nil
-// 	}
-
-// 	if !file.ModTime.IsZero() && remote.LastModified.After(file.ModTime) {
-// 		return false, nil
-// 	}
-
-// 	if file.Size != 0 && file.Size == remote.Size {
-// 		return false, nil
-// 	}
-
-// 	return true, nil
-// }
+// shouldUpload reports whether the bucket is missing an identical copy of the
+// file. Large files only have a sha1 when one was given at upload time.
+func (b2 *B2Destination) shouldUpload(ctx context.Context, obj *blazer.Object, sha1 string) (bool, error) {
+	remote, err := obj.Attrs(ctx)
+	if err != nil {
+		if blazer.IsNotExist(err) {
+			return true, nil
+		}
+		return true, fmt.Errorf("getting b2 obj attributes: %w", err)
+	}
+
+	if remote.Status != blazer.Uploaded || remote.SHA1 == "" || remote.SHA1 == "none" {
+		return true, nil
+	}
+
+	return remote.SHA1 != sha1, nil
+}
@@ -0,0 +1,217 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var _ Destination = (*CacheDestination)(nil)
+
+// CacheDestination is a read-through cache in front of another destination.
+// Small files (mostly manifests) are kept in memory or in a local directory so
+// the reupload fast path doesn't need a network round trip.
+type CacheDestination struct {
+	next    Destination
+	root    *os.Root // nil when caching in memory
+	ttl     time.Duration
+	maxFile int64
+	entries *lru[cacheEntry]
+}
+
+type cacheEntry struct {
+	cachedAt time.Time
+	content  []byte // nil when the content lives on disk
+}
+
+// NewCacheDestination wraps next using the cache options from the destination url:
+//
+//	cache=memory|/some/dir  where to keep cached files, memory when empty
+//	cache_size=64MB         total size of the cache
+//	cache_ttl=1h            how long a cached file is trusted
+//	cache_max_file=1MB      files larger than this are never cached
+func NewCacheDestination(next Destination, config *url.URL) (*CacheDestination, error) {
+	query := config.Query()
+	dest := &CacheDestination{
+		next:    next,
+		ttl:     time.Hour,
+		maxFile: megaByte,
+	}
+
+	maxSize := int64(64 * megaByte)
+	if raw := query.Get("cache_size"); raw != "" {
+		size, err := parseByteSize(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing cache_size: %w", err)
+		}
+		maxSize = size
+	}
+	if raw := query.Get("cache_max_file"); raw != "" {
+		size, err := parseByteSize(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing cache_max_file: %w", err)
+		}
+		dest.maxFile = size
+	}
+	if raw := query.Get("cache_ttl"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing cache_ttl: %w", err)
+		}
+		dest.ttl = ttl
+	}
+
+	// a file bigger than the whole cache would be written only to be evicted
+	dest.maxFile = min(dest.maxFile, maxSize)
+	dest.entries = newLRU(maxSize, dest.evict)
+
+	if dir := query.Get("cache"); dir != "" && dir != "memory" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("creating cache dir: %w", err)
+		}
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			return nil, fmt.Errorf("opening cache dir: %w", err)
+		}
+		dest.root = root
+		dest.loadDisk()
+	}
+
+	return dest, nil
+}
+
+// loadDisk indexes files left over from a previous run. Files that no longer
+// fit are evicted by the lru as they are added.
+func (c *CacheDestination) loadDisk() {
+	entries, _ := fs.ReadDir(c.root.FS(), ".")
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if time.Since(info.ModTime()) > c.ttl {
+			_ = c.root.Remove(entry.Name())
+			continue
+		}
+		c.entries.Add(entry.Name(), cacheEntry{cachedAt: info.ModTime()}, info.Size())
+	}
+}
+
+func (c *CacheDestination) String() string {
+	where := "memory"
+	if c.root != nil {
+		where = c.root.Name()
+	}
+	return fmt.Sprintf("%s (cached in %s ttl=%s)", c.next, where, c.ttl)
+}
+
+func (c *CacheDestination) Close() error {
+	var err error
+	if c.root != nil {
+		err = c.root.Close()
+	}
+	return errors.Join(c.next.Close(), err)
+}
+
+func (c *CacheDestination) Unwrap() Destination {
+	return c.next
+}
+
+func (c *CacheDestination) Download(ctx context.Context, name string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "cache_download")
+	defer span.End()
+
+	if content, ok := c.get(name); ok {
+		span.SetAttributes(attribute.Bool("cache_hit", true))
+		return content, nil
+	}
+	span.SetAttributes(attribute.Bool("cache_hit", false))
+
+	content, err := c.next.Download(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(name, content)
+	return content, nil
+}
+
+func (c *CacheDestination) Upload(ctx context.Context, name string, content []byte) error {
+	c.invalidate(name)
+
+	err := c.next.Upload(ctx, name, content)
+	if err != nil {
+		return err
+	}
+
+	c.put(name, content)
+	return nil
+}
+
+func (c *CacheDestination) Exists(ctx context.Context, name string) (bool, error) {
+	if _, ok := c.get(name); ok {
+		return true, nil
+	}
+	return ObjectExists(ctx, c.next, name)
+}
+
+func (c *CacheDestination) Delete(ctx context.Context, name string) error {
+	c.invalidate(name)
+	return DeleteObject(ctx, c.next, name)
+}
+
+func (c *CacheDestination) get(name string) ([]byte, bool) {
+	entry, ok := c.entries.Get(name)
+	if !ok {
+		return nil, false
+	}
+	if time.Since(entry.cachedAt) > c.ttl {
+		c.invalidate(name)
+		return nil, false
+	}
+	if c.root == nil {
+		return entry.content, true
+	}
+
+	content, err := c.root.ReadFile(name)
+	if err != nil {
+		c.invalidate(name)
+		return nil, false
+	}
+	return content, true
+}
+
+func (c *CacheDestination) put(name string, content []byte) {
+	size := int64(len(content))
+	if size > c.maxFile || validateSimpleFilename(name) != nil {
+		return
+	}
+
+	entry := cacheEntry{cachedAt: time.Now()}
+	if c.root == nil {
+		entry.content = content
+	} else if err := c.root.WriteFile(name, content, 0644); err != nil {
+		return
+	}
+	if !c.entries.Add(name, entry, size) {
+		c.evict(name, entry)
+	}
+}
+
+func (c *CacheDestination) invalidate(name string) {
+	if entry, ok := c.entries.Remove(name); ok {
+		c.evict(name, entry)
+	}
+}
+
+func (c *CacheDestination) evict(name string, _ cacheEntry) {
+	if c.root != nil {
+		_ = c.root.Remove(name)
+	}
+}
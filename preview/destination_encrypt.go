@@ -0,0 +1,153 @@
+package preview
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+var _ Destination = (*EncryptDestination)(nil)
+
+var encryptMagic = []byte("DVPE1")
+
+// EncryptDestination encrypts files with AES-256-GCM before handing them to
+// another destination, so the storage provider only ever sees ciphertext.
+// The file name is authenticated along with the content.
+//
+// Every upload is sealed with a fresh random nonce, so the same file never
+// encrypts to the same bytes twice. Backends that skip identical uploads, like
+// B2 comparing sha1s, therefore always upload again; content-addressed storage
+// still dedupes since it checks blob names before uploading.
+//
+// Public links must go through our own host to be readable, see
+// NewFileHandler and the PROXY setting, or the fs destination's server, which
+// decrypts when both are configured. There is deliberately no Unwrap method so
+// the backend's own public url, which serves ciphertext, is never used.
+type EncryptDestination struct {
+	next       Destination
+	aead       cipher.AEAD
+	allowPlain bool
+}
+
+// NewEncryptDestination wraps next using the options from the destination url:
+//
+//	encrypt_key=env:MEDIA_KEY  32 byte key, hex or base64 encoded
+//	encrypt_allow_plain=1      read files stored before encryption was enabled
+func NewEncryptDestination(next Destination, config *url.URL) (*EncryptDestination, error) {
+	query := config.Query()
+
+	rawKey, err := secretParam(query, "encrypt_key")
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(rawKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcm: %w", err)
+	}
+
+	dest := &EncryptDestination{next: next, aead: aead}
+	if raw := query.Get("encrypt_allow_plain"); raw != "" {
+		if dest.allowPlain, err = strconv.ParseBool(raw); err != nil {
+			return nil, fmt.Errorf("parsing encrypt_allow_plain: %w", err)
+		}
+	}
+
+	return dest, nil
+}
+
+func decodeKey(raw string) ([]byte, error) {
+	if key, err := hex.DecodeString(raw); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(raw); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("expecting encrypt_key to be 32 bytes encoded as hex or base64")
+}
+
+func (e *EncryptDestination) String() string {
+	return fmt.Sprintf("%s (encrypted)", e.next)
+}
+
+func (e *EncryptDestination) Close() error {
+	return e.next.Close()
+}
+
+func (e *EncryptDestination) Upload(ctx context.Context, name string, content []byte) error {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+
+	sealed := make([]byte, 0, len(encryptMagic)+len(nonce)+len(content)+e.aead.Overhead())
+	sealed = append(sealed, encryptMagic...)
+	sealed = append(sealed, nonce...)
+	sealed = e.aead.Seal(sealed, nonce, content, []byte(name))
+
+	return e.next.Upload(ctx, name, sealed)
+}
+
+func (e *EncryptDestination) Download(ctx context.Context, name string) ([]byte, error) {
+	sealed, err := e.next.Download(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(sealed, encryptMagic) {
+		if e.allowPlain {
+			return sealed, nil
+		}
+		return nil, fmt.Errorf("expecting %s to be encrypted", name)
+	}
+
+	sealed = sealed[len(encryptMagic):]
+	if len(sealed) < e.aead.NonceSize() {
+		return nil, fmt.Errorf("decrypting %s: truncated", name)
+	}
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+
+	content, err := e.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	return content, nil
+}
+
+func (e *EncryptDestination) Exists(ctx context.Context, name string) (bool, error) {
+	return ObjectExists(ctx, e.next, name)
+}
+
+func (e *EncryptDestination) Delete(ctx context.Context, name string) error {
+	return DeleteObject(ctx, e.next, name)
+}
+
+// List reports plaintext sizes so they can be compared with manifest checksums.
+// With encrypt_allow_plain, telling old plain files apart would mean
+// downloading them, so they are assumed to be encrypted too and reported
+// smaller than they are.
+func (e *EncryptDestination) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	overhead := int64(len(encryptMagic) + e.aead.NonceSize() + e.aead.Overhead())
+	return ListObjects(ctx, e.next, func(obj ObjectInfo) error {
+		if obj.Size >= overhead {
+			obj.Size -= overhead
+		}
+		return fn(obj)
+	})
+}
@@ -4,18 +4,36 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
+	iofs "io/fs"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var _ Destination = (*FSDestination)(nil)
 
+// FSDestination stores files in a local directory and can optionally serve
+// them over http.
+//
+//	fs:///data?server=:8080&fsync=1&shard=2
+//
+// server is host:port or unix:/path/to.sock and is bound before
+// NewFSDestination returns; tls_cert and tls_key switch it to https. With
+// encrypt_key the server is started by NewDestination and decrypts files.
+// fsync flushes every file (and its directory) to disk before Upload returns.
+// shard spreads files across nested two-character directories so that
+// abcd1234.mp4 is stored as ab/cd/abcd1234.mp4. Files stored before sharding
+// was turned on are still found at their flat path. The server serves files by
+// their plain name either way, see newFileServer for its options.
 type FSDestination struct {
 	root   *os.Root
-	server *http.Server
+	server *httpServer
+	files  *fileServer // nil without a server
+	fsync  bool
+	shard  int
 }
 
 func NewFSDestination(ctx context.Context, config *url.URL) (*FSDestination, error) {
@@ -24,58 +42,57 @@ func NewFSDestination(ctx context.Context, config *url.URL) (*FSDestination, err
 	dest := FSDestination{}
 	var err error
 
+	if raw := query.Get("fsync"); raw != "" {
+		dest.fsync, err = strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing fsync: %w", err)
+		}
+	}
+
+	if raw := query.Get("shard"); raw != "" {
+		dest.shard, err = strconv.Atoi(raw)
+		if err != nil || dest.shard < 0 || dest.shard > 4 {
+			return nil, fmt.Errorf("expecting shard to be between 0 and 4: %q", raw)
+		}
+	}
+
 	dest.root, err = os.OpenRoot(path)
 	if err != nil {
 		return nil, fmt.Errorf("opening root: %w", err)
 	}
 
+	// with encryption the server has to decrypt, so NewDestination starts it
+	// once the encrypting wrapper exists
 	serverAddr := query.Get("server")
-	if serverAddr != "" {
-		err = dest.startServer(serverAddr)
+	if serverAddr != "" && !query.Has("encrypt_key") {
+		err = dest.startServer(serverAddr, &dest, config)
 		if err != nil {
+			_ = dest.root.Close()
 			return nil, fmt.Errorf("starting server: %w", err)
 		}
 	}
 
-	// rawCleanupGb := query.Get("cleanup")
-	// if rawCleanupGb != "" {
-	// 	cleanupGb, err := strconv.ParseFloat(rawCleanupGb, 32)
-	// }
-
-	// TODO start server if host and port, actually move to just using one "server" query
-	// note: dont need to use merge fs, I will just "upload" the static files to the dest
-
 	// TODO start cleanup job (remote sentry integration) if maxgb
 
 	return &dest, nil
 }
 
-func (fs *FSDestination) startServer(addr string) error {
-	fs.server = &http.Server{
-		Addr:    addr,
-		Handler: files(http.FileServer(http.Dir(fs.root.Name()))),
-
-		ReadHeaderTimeout:            5 * time.Second,
-		DisableGeneralOptionsHandler: true,
+// startServer serves files, which is the destination itself or a wrapper of it.
+func (fs *FSDestination) startServer(addr string, files iofs.FS, config *url.URL) error {
+	handler, err := newFileServer(files, config)
+	if err != nil {
+		return err
 	}
+	fs.files = handler
 
-	var startupErr error
-	go func() {
-		err := fs.server.ListenAndServe()
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			startupErr = err
-			//todo: log
-		}
-	}()
-
-	time.Sleep(100 * time.Millisecond)
-	return startupErr
+	fs.server, err = startHTTPServer(addr, handler, config)
+	return err
 }
 
 func (fs *FSDestination) String() string {
 	addr := "none"
 	if fs.server != nil {
-		addr = fs.server.Addr
+		addr = fs.server.String()
 	}
 	return fmt.Sprintf("filesystem destination at %s server=%s", fs.root.Name(), addr)
 }
@@ -85,11 +102,7 @@ func (fs *FSDestination) Close() error {
 
 	// Shutdown HTTP server if running
 	if fs.server != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if shutdownErr := fs.server.Shutdown(ctx); shutdownErr != nil {
-			err = shutdownErr
-		}
+		err = fs.server.Close()
 	}
 
 	// Close the root filesystem
@@ -103,12 +116,55 @@ func (fs *FSDestination) Close() error {
 	return err
 }
 
-func (fs *FSDestination) Upload(ctx context.Context, name string, content []byte) error {
+// Upload writes to a hidden temporary file next to the final path and renames
+// it into place, so readers never see a partially written file.
+func (fs *FSDestination) Upload(ctx context.Context, name string, content []byte) (err error) {
 	if err := validateSimpleFilename(name); err != nil {
 		return err
 	}
 
-	return fs.root.WriteFile(name, content, os.FileMode(0644))
+	path := fs.path(name)
+	dir := filepath.Dir(path)
+	if dir != "." {
+		if err := fs.root.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("creating shard dir: %w", err)
+		}
+	}
+
+	tmp := filepath.Join(dir, "."+name+".tmp-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	f, err := fs.root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = fs.root.Remove(tmp)
+		}
+	}()
+
+	_, err = f.Write(content)
+	if err == nil && fs.fsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing temp file: %w", err)
+	}
+
+	if err = fs.root.Rename(tmp, path); err != nil {
+		return fmt.Errorf("renaming temp file: %w", err)
+	}
+	fs.forget(name)
+
+	if fs.fsync {
+		if err = fs.syncDir(dir); err != nil {
+			return fmt.Errorf("syncing dir: %w", err)
+		}
+	}
+
+	return nil
 }
 
 func (fs *FSDestination) Download(ctx context.Context, name string) ([]byte, error) {
@@ -116,185 +172,120 @@ func (fs *FSDestination) Download(ctx context.Context, name string) ([]byte, err
 		return nil, err
 	}
 
-	return fs.root.ReadFile(name) // TODO normalized not found
+	content, err := fs.root.ReadFile(fs.lookup(name))
+	if err != nil {
+		if errors.Is(err, iofs.ErrNotExist) {
+			return nil, notExist(name)
+		}
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+	return content, nil
 }
 
-func files(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		if req.Method != "GET" && req.Method != "HEAD" {
-			res.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
+func (fs *FSDestination) Exists(ctx context.Context, name string) (bool, error) {
+	if err := validateSimpleFilename(name); err != nil {
+		return false, err
+	}
 
-		// prevent directory listings
-		if req.URL.Path != "/" && strings.HasSuffix(req.URL.Path, "/") {
-			http.NotFound(res, req)
-			return
+	_, err := fs.root.Stat(fs.lookup(name))
+	if err != nil {
+		if errors.Is(err, iofs.ErrNotExist) {
+			return false, nil
 		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (fs *FSDestination) Delete(ctx context.Context, name string) error {
+	if err := validateSimpleFilename(name); err != nil {
+		return err
+	}
 
-		// TODO revisit this
-		if strings.HasSuffix(req.URL.Path, ".mp4") {
-			res.Header().Set("Content-Type", "video/mp4")
-			res.Header().Set("Cache-Control", "public, max-age=31536000")
-		} else {
-			res.Header().Set("Cache-Control", "public, max-age=3600")
+	defer fs.forget(name)
+	err := fs.root.Remove(fs.path(name))
+	if fs.path(name) != name {
+		// a copy from before sharding was turned on would reappear
+		flatErr := fs.root.Remove(name)
+		switch {
+		case errors.Is(err, iofs.ErrNotExist):
+			err = flatErr
+		case err == nil && !errors.Is(flatErr, iofs.ErrNotExist):
+			err = flatErr
 		}
+	}
+	if errors.Is(err, iofs.ErrNotExist) {
+		return notExist(name)
+	}
+	return err
+}
 
-		next.ServeHTTP(res, req)
+func (fs *FSDestination) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return iofs.WalkDir(fs.root.FS(), ".", func(path string, entry iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
 	})
 }
 
-//
-////go:embed web/*
-//var webFS embed.FS
-//
-//func oldmain(ctx context.Context) {
-//
-//	job(ctx, "delete-old-previews", time.Minute, time.Hour, func() error {
-//		return deleteOldPreviews(args.StaticDir, 20)
-//	})
-//
-//	subFS, err := fs.Sub(webFS, "web")
-//	if err != nil {
-//		return fmt.Errorf("fs.Sub: %w", err)
-//	}
-//
-//	httpServer := &http.Server{
-//		Addr:              args.Host + ":" + args.Port,
-//		Handler:           files(http.FileServer(&mergeFS{http.FS(subFS), http.Dir(args.StaticDir)})),
-//		ReadHeaderTimeout: 10 * time.Second,
-//	}
-//
-//	errChan := make(chan error, 1)
-//	go func() {
-//		slog.InfoContext(ctx, "httpServer started", "addr", httpServer.Addr)
-//		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-//			errChan <- err
-//		}
-//	}()
-//
-//	http.FS(webFS)
-//
-//	select {
-//	case err := <-errChan:
-//		return err
-//	case <-ctx.Done():
-//		slog.InfoContext(ctx, "shutting down httpServer")
-//	}
-//
-//	ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
-//	defer cancel()
-//	return httpServer.Shutdown(ctx)
-//}
-//
-//func files(next http.Handler) http.Handler {
-//	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-//		if req.Method != "GET" && req.Method != "HEAD" {
-//			res.WriteHeader(http.StatusMethodNotAllowed)
-//			return
-//		}
-//
-//		// Prevent directory listings
-//		if req.URL.Path != "/" && strings.HasSuffix(req.URL.Path, "/") {
-//			http.NotFound(res, req)
-//			return
-//		}
-//
-//		if strings.HasSuffix(req.URL.Path, ".mp4") {
-//			res.Header().Set("Content-Type", "video/mp4")
-//			res.Header().Set("Cache-Control", "public, max-age=31536000")
-//		} else {
-//			res.Header().Set("Cache-Control", "public, max-age=3600")
-//		}
-//
-//		next.ServeHTTP(res, req)
-//	})
-//}
-//
-//func job(ctx context.Context, slug string, timeout, interval time.Duration, jobFunc func() error) {
-//	go func() {
-//		hub := sentry.CurrentHub().Clone()
-//		hub.ConfigureScope(func(scope *sentry.Scope) {
-//			scope.SetContext("monitor", sentry.Context{"slug": slug})
-//		})
-//		time.Sleep(timeout)
-//		for {
-//			hub.CaptureCheckIn(&sentry.CheckIn{
-//				MonitorSlug: slug,
-//				Status:      sentry.CheckInStatusInProgress,
-//			}, nil)
-//			if err := jobFunc(); err != nil {
-//				hub.CaptureCheckIn(&sentry.CheckIn{
-//					MonitorSlug: slug,
-//					Status:      sentry.CheckInStatusError,
-//				}, nil)
-//				hub.CaptureException(err)
-//			} else {
-//				hub.CaptureCheckIn(&sentry.CheckIn{
-//					MonitorSlug: slug,
-//					Status:      sentry.CheckInStatusOK,
-//				}, nil)
-//			}
-//			select {
-//			case <-ctx.Done():
-//				return
-//			case <-time.After(interval):
-//				continue
-//			}
-//		}
-//	}()
-//}
-//
-//func deleteOldPreviews(dir string, maxGb int) error {
-//	files, err := ioutil.ReadDir(dir)
-//	if err != nil {
-//		return err
-//	}
-//
-//	var maxBytes int64 = int64(maxGb) * 1_000_000_000
-//
-//	var dirSize int64
-//	for _, file := range files {
-//		dirSize += file.Size()
-//	}
-//
-//	if dirSize <= maxBytes {
-//		return nil
-//	}
-//
-//	sort.Slice(files, func(i, j int) bool { // Sort most recent first
-//		return files[i].ModTime().After(files[j].ModTime())
-//	})
-//
-//	var runningDirSize int64 = 0
-//	var targetDirSize int64 = int64(float64(maxBytes) * 0.80)
-//	for _, file := range files {
-//		runningDirSize += file.Size()
-//		if runningDirSize > targetDirSize {
-//			if err = os.Remove(filepath.Join(dir, file.Name())); err != nil {
-//				return err
-//			}
-//		}
-//	}
-//
-//	return nil
-//}
-//
-//type mergeFS struct {
-//	a http.FileSystem
-//	b http.FileSystem
-//}
-//
-//func (m *mergeFS) Open(name string) (http.File, error) {
-//	file, err := m.a.Open(name)
-//	if err == nil {
-//		return file, nil
-//	}
-//
-//	file, err = m.b.Open(name)
-//	if err == nil {
-//		return file, nil
-//	}
-//
-//	return nil, err
-//}
+// Open implements fs.FS over the logical (unsharded) file names.
+func (fs *FSDestination) Open(name string) (iofs.File, error) {
+	if name == "." || validateSimpleFilename(name) != nil {
+		return fs.root.Open(name)
+	}
+	return fs.root.Open(fs.lookup(name))
+}
+
+// path returns where name is stored relative to the root.
+func (fs *FSDestination) path(name string) string {
+	parts := make([]string, 0, fs.shard+1)
+	for i := 0; i < fs.shard; i++ {
+		if len(name) < (i+1)*2+1 {
+			break
+		}
+		parts = append(parts, name[i*2:(i+1)*2])
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+// forget tells the server name changed so it doesn't reuse its old etag.
+func (fs *FSDestination) forget(name string) {
+	if fs.files != nil {
+		fs.files.forget(name)
+	}
+}
+
+// lookup returns where name is stored, falling back to the flat layout for
+// files written before sharding was turned on.
+func (fs *FSDestination) lookup(name string) string {
+	path := fs.path(name)
+	if path == name {
+		return path
+	}
+	if _, err := fs.root.Stat(path); errors.Is(err, iofs.ErrNotExist) {
+		if _, err := fs.root.Stat(name); err == nil {
+			return name
+		}
+	}
+	return path
+}
+
+func (fs *FSDestination) syncDir(dir string) error {
+	f, err := fs.root.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,184 @@
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+var _ Destination = (*MemDestination)(nil)
+
+var errMemTooLarge = errors.New("file is larger than the memory destination")
+
+// MemDestination keeps files in memory, evicting the least recently used ones
+// once the byte budget is spent. Manifests go along with the files they list,
+// so the reuploader never hands out links to evicted files. It's meant for
+// tests and throwaway setups like the web tester.
+//
+//	mem://?size=256MB&server=:8080
+//
+// server takes the same options as the fs destination's server.
+type MemDestination struct {
+	files  *lru[memObject]
+	server *httpServer
+
+	mu        sync.Mutex
+	manifests map[string][]string // file name -> manifests that may list it
+}
+
+type memObject struct {
+	content []byte
+	modTime time.Time
+}
+
+func NewMemDestination(ctx context.Context, config *url.URL) (*MemDestination, error) {
+	query := config.Query()
+
+	maxSize := int64(256 * megaByte)
+	if raw := query.Get("size"); raw != "" {
+		size, err := parseByteSize(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing size: %w", err)
+		}
+		maxSize = size
+	}
+
+	dest := &MemDestination{manifests: map[string][]string{}}
+	dest.files = newLRU(maxSize, dest.evict)
+
+	if addr := query.Get("server"); addr != "" {
+		handler, err := newFileServer(dest, config)
+		if err != nil {
+			return nil, fmt.Errorf("starting server: %w", err)
+		}
+		dest.server, err = startHTTPServer(addr, handler, config)
+		if err != nil {
+			return nil, fmt.Errorf("starting server: %w", err)
+		}
+	}
+
+	return dest, nil
+}
+
+func (m *MemDestination) String() string {
+	addr := "none"
+	if m.server != nil {
+		addr = m.server.String()
+	}
+	return fmt.Sprintf("memory destination holding %d bytes server=%s", m.files.Size(), addr)
+}
+
+func (m *MemDestination) Close() error {
+	if m.server != nil {
+		return m.server.Close()
+	}
+	return nil
+}
+
+func (m *MemDestination) Upload(ctx context.Context, name string, content []byte) error {
+	if err := validateSimpleFilename(name); err != nil {
+		return err
+	}
+
+	// copy so callers can't change stored files through their slice
+	obj := memObject{content: append([]byte(nil), content...), modTime: time.Now()}
+	if !m.files.Add(name, obj, int64(len(content))) {
+		return fmt.Errorf("%s: %w", name, errMemTooLarge)
+	}
+
+	if isManifestName(name) {
+		var manifest Manifest
+		if json.Unmarshal(content, &manifest) == nil {
+			m.mu.Lock()
+			for _, file := range manifest.Files {
+				if !slices.Contains(m.manifests[file], name) {
+					m.manifests[file] = append(m.manifests[file], name)
+				}
+			}
+			m.mu.Unlock()
+
+			// files evicted from here on take the manifest with them, but
+			// one may have gone before it was registered
+			for _, file := range manifest.Files {
+				if _, ok := m.files.Get(file); !ok {
+					m.files.Remove(name)
+					return fmt.Errorf("manifest %s lists an evicted file: %w", name, notExist(file))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// evict removes the manifests that still list an evicted file.
+func (m *MemDestination) evict(name string, _ memObject) {
+	m.mu.Lock()
+	manifests := m.manifests[name]
+	delete(m.manifests, name)
+	m.mu.Unlock()
+
+	for _, manifestName := range manifests {
+		obj, ok := m.files.Get(manifestName)
+		if !ok {
+			continue
+		}
+		var manifest Manifest
+		if json.Unmarshal(obj.content, &manifest) == nil && slices.Contains(manifest.Files, name) {
+			m.files.Remove(manifestName)
+		}
+	}
+}
+
+func (m *MemDestination) Download(ctx context.Context, name string) ([]byte, error) {
+	obj, ok := m.files.Get(name)
+	if !ok {
+		return nil, notExist(name)
+	}
+	// copy for the same reason as in Upload
+	return append([]byte(nil), obj.content...), nil
+}
+
+func (m *MemDestination) Exists(ctx context.Context, name string) (bool, error) {
+	_, ok := m.files.Get(name)
+	return ok, nil
+}
+
+func (m *MemDestination) Delete(ctx context.Context, name string) error {
+	if _, ok := m.files.Remove(name); !ok {
+		return notExist(name)
+	}
+	m.mu.Lock()
+	delete(m.manifests, name)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemDestination) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	var objects []ObjectInfo
+	m.files.Each(func(name string, obj memObject, size int64) bool {
+		objects = append(objects, ObjectInfo{Name: name, Size: size, ModTime: obj.modTime})
+		return true
+	})
+
+	for _, obj := range objects {
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open implements fs.FS for the built-in server.
+func (m *MemDestination) Open(name string) (fs.File, error) {
+	obj, ok := m.files.Get(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return newMemFile(name, obj.content, obj.modTime), nil
+}
@@ -3,12 +3,14 @@ package preview
 import (
 	"bytes"
 	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"net/http"
 	"net/url"
+	"path"
+	"strings"
 )
 
 var _ Destination = (*RCloneWebDAVDestination)(nil)
@@ -50,20 +52,20 @@ func (r *RCloneWebDAVDestination) Download(ctx context.Context, name string) ([]
 	}
 	defer resp.Body.Close()
 
-	if resp.ContentLength > MaxMediaSize {
-		return nil, errors.New("media too large")
-	} else if resp.ContentLength <= 0 {
-		return nil, errors.New("media is empty")
-	}
-
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, fs.ErrNotExist
+		return nil, notExist(name)
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
 	}
 
+	if resp.ContentLength > MaxMediaSize {
+		return nil, errors.New("media too large")
+	} else if resp.ContentLength <= 0 {
+		return nil, errors.New("media is empty")
+	}
+
 	content := make([]byte, resp.ContentLength)
 	_, err = io.ReadFull(resp.Body, content)
 	if err != nil {
@@ -88,6 +90,9 @@ func (r *RCloneWebDAVDestination) Upload(ctx context.Context, name string, conte
 		return fmt.Errorf("creating upload request: %w", err)
 	}
 	req.ContentLength = int64(len(content))
+	if contentType := contentTypeByName(name); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 
 	resp, err := httpDo(req)
 	if err != nil {
@@ -101,3 +106,113 @@ func (r *RCloneWebDAVDestination) Upload(ctx context.Context, name string, conte
 
 	return nil
 }
+
+func (r *RCloneWebDAVDestination) Exists(ctx context.Context, name string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "rclone+webdav_exists")
+	defer span.End()
+
+	if err := validateSimpleFilename(name); err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, urlCat(r.baseURL, name), nil)
+	if err != nil {
+		return false, fmt.Errorf("creating head request: %w", err)
+	}
+
+	resp, err := httpDo(req)
+	if err != nil {
+		return false, fmt.Errorf("checking file on rclone+webdav: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	return true, nil
+}
+
+func (r *RCloneWebDAVDestination) Delete(ctx context.Context, name string) error {
+	ctx, span := tracer.Start(ctx, "rclone+webdav_delete")
+	defer span.End()
+
+	if err := validateSimpleFilename(name); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, urlCat(r.baseURL, name), nil)
+	if err != nil {
+		return fmt.Errorf("creating delete request: %w", err)
+	}
+
+	resp, err := httpDo(req)
+	if err != nil {
+		return fmt.Errorf("deleting file from rclone+webdav: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return notExist(name)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	return nil
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+		Prop struct {
+			ContentLength int64     `xml:"getcontentlength"`
+			LastModified  string    `xml:"getlastmodified"`
+			ResourceType  *struct{} `xml:"resourcetype>collection"`
+		} `xml:"propstat>prop"`
+	} `xml:"response"`
+}
+
+func (r *RCloneWebDAVDestination) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	ctx, span := tracer.Start(ctx, "rclone+webdav_list")
+	defer span.End()
+
+	body := strings.NewReader(`<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getcontentlength/><getlastmodified/><resourcetype/></prop></propfind>`)
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", urlCat(r.baseURL, ""), body)
+	if err != nil {
+		return fmt.Errorf("creating propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := httpDo(req)
+	if err != nil {
+		return fmt.Errorf("listing rclone+webdav: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return fmt.Errorf("parsing propfind response: %w", err)
+	}
+
+	for _, res := range ms.Responses {
+		if res.Prop.ResourceType != nil {
+			continue // the directory itself
+		}
+		name, err := url.PathUnescape(path.Base(res.Href))
+		if err != nil {
+			continue
+		}
+		modTime, _ := http.ParseTime(res.Prop.LastModified)
+		if err := fn(ObjectInfo{Name: name, Size: res.Prop.ContentLength, ModTime: modTime}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
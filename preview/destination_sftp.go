@@ -0,0 +1,411 @@
+package preview
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var _ Destination = (*SFTPDestination)(nil)
+
+// SFTPDestination stores files in a directory on an ssh server.
+//
+//	sftp://user@host:22/srv/media?key=/home/bot/.ssh/id_ed25519
+//
+// Authentication uses the key file in key (with key_passphrase if it is
+// encrypted) and/or the password from the url or the password option, both of
+// which accept env:NAME. The server's host key is checked against known_hosts,
+// ~/.ssh/known_hosts by default; insecure_ignore_host_key=1 skips the check and
+// is only meant for testing.
+//
+// The connection is opened on first use and reopened after it drops.
+type SFTPDestination struct {
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func NewSFTPDestination(ctx context.Context, config *url.URL) (*SFTPDestination, error) {
+	query := config.Query()
+
+	if config.User == nil || config.User.Username() == "" {
+		return nil, errors.New("expecting a user in the sftp url")
+	}
+
+	auth, err := sftpAuthMethods(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sftpHostKeyCallback(query)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := config.Host
+	if config.Port() == "" {
+		addr = net.JoinHostPort(config.Hostname(), "22")
+	}
+
+	dir := config.Path
+	if dir == "" {
+		dir = "."
+	}
+
+	return &SFTPDestination{
+		addr: addr,
+		dir:  dir,
+		config: &ssh.ClientConfig{
+			User:            config.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+func sftpAuthMethods(config *url.URL) ([]ssh.AuthMethod, error) {
+	query := config.Query()
+	var auth []ssh.AuthMethod
+
+	if keyPath := query.Get("key"); keyPath != "" {
+		keyBytes, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading key: %w", err)
+		}
+		passphrase, err := secretParam(query, "key_passphrase")
+		if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		if passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(keyBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	password, _ := config.User.Password()
+	if query.Has("password") {
+		var err error
+		password, err = secretParam(query, "password")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	if len(auth) == 0 {
+		return nil, errors.New("expecting a key or password for sftp")
+	}
+	return auth, nil
+}
+
+func sftpHostKeyCallback(query url.Values) (ssh.HostKeyCallback, error) {
+	if raw := query.Get("insecure_ignore_host_key"); raw != "" {
+		ignore, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing insecure_ignore_host_key: %w", err)
+		}
+		if ignore {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
+	}
+
+	knownHostsPath := query.Get("known_hosts")
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("finding known_hosts: %w", err)
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading known_hosts: %w", err)
+	}
+	return callback, nil
+}
+
+func (d *SFTPDestination) String() string {
+	return fmt.Sprintf("sftp: %s@%s:%s", d.config.User, d.addr, d.dir)
+}
+
+func (d *SFTPDestination) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	_ = d.conn.Close()
+	d.client, d.conn = nil, nil
+	return err
+}
+
+// sftp returns the open client, connecting first if needed.
+func (d *SFTPDestination) sftp(ctx context.Context) (*sftp.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	dialer := net.Dialer{Timeout: d.config.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", d.addr, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, d.addr, d.config)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, fmt.Errorf("ssh handshake with %s: %w", d.addr, err)
+	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("starting sftp session: %w", err)
+	}
+	if err := client.MkdirAll(d.dir); err != nil {
+		_ = client.Close()
+		_ = conn.Close()
+		return nil, fmt.Errorf("creating %s: %w", d.dir, err)
+	}
+
+	d.conn, d.client = conn, client
+
+	// forget the connection once it drops so the next call reconnects
+	go func() {
+		_ = conn.Wait()
+		d.mu.Lock()
+		if d.conn == conn {
+			_ = client.Close()
+			d.client, d.conn = nil, nil
+		}
+		d.mu.Unlock()
+	}()
+
+	return client, nil
+}
+
+func (d *SFTPDestination) path(name string) string {
+	return path.Join(d.dir, name)
+}
+
+func (d *SFTPDestination) Upload(ctx context.Context, name string, content []byte) error {
+	ctx, span := tracer.Start(ctx, "sftp_upload")
+	defer span.End()
+
+	if err := validateSimpleFilename(name); err != nil {
+		return err
+	}
+
+	client, err := d.sftp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary name first so readers never see a partial file
+	tmp := d.path(fmt.Sprintf(".%s.tmp-%d", name, time.Now().UnixNano()))
+	f, err := client.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	_, err = f.ReadFrom(&ctxReader{ctx: ctx, r: bytes.NewReader(content)})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = client.Remove(tmp)
+		return fmt.Errorf("writing file: %w", err)
+	}
+
+	if err := d.rename(client, tmp, d.path(name)); err != nil {
+		_ = client.Remove(tmp)
+		return fmt.Errorf("renaming file: %w", err)
+	}
+	return nil
+}
+
+// rename replaces newname atomically when the server supports the openssh
+// posix-rename extension. Plain sftp rename refuses to overwrite, so without it
+// the old file is removed first.
+func (d *SFTPDestination) rename(client *sftp.Client, oldname, newname string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldname, newname)
+	}
+	if err := client.Remove(newname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(oldname, newname)
+}
+
+func (d *SFTPDestination) Download(ctx context.Context, name string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "sftp_download")
+	defer span.End()
+
+	if err := validateSimpleFilename(name); err != nil {
+		return nil, err
+	}
+
+	client, err := d.sftp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(d.path(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, notExist(name)
+		}
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+	if info.Size() > MaxMediaSize {
+		return nil, errors.New("media too large")
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(int(info.Size()))
+	if _, err := f.WriteTo(&ctxWriter{ctx: ctx, w: &buf}); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ctxReader stops a transfer between packets once ctx is done, since the sftp
+// client's own calls don't take a context. Len keeps concurrent writes on.
+type ctxReader struct {
+	ctx context.Context
+	r   *bytes.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+func (cr *ctxReader) Len() int {
+	return cr.r.Len()
+}
+
+// ctxWriter is ctxReader for downloads.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *ctxWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+func (d *SFTPDestination) Exists(ctx context.Context, name string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "sftp_exists")
+	defer span.End()
+
+	if err := validateSimpleFilename(name); err != nil {
+		return false, err
+	}
+
+	client, err := d.sftp(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.Stat(d.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("stat file: %w", err)
+	}
+	return true, nil
+}
+
+func (d *SFTPDestination) Delete(ctx context.Context, name string) error {
+	ctx, span := tracer.Start(ctx, "sftp_delete")
+	defer span.End()
+
+	if err := validateSimpleFilename(name); err != nil {
+		return err
+	}
+
+	client, err := d.sftp(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = client.Remove(d.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return notExist(name)
+	}
+	if err != nil {
+		return fmt.Errorf("deleting file: %w", err)
+	}
+	return nil
+}
+
+func (d *SFTPDestination) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	ctx, span := tracer.Start(ctx, "sftp_list")
+	defer span.End()
+
+	client, err := d.sftp(ctx)
+	if err != nil {
+		return err
+	}
+
+	entries, err := client.ReadDirContext(ctx, d.dir)
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", d.dir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || entry.Name()[0] == '.' {
+			continue // skip directories and in-flight temporary files
+		}
+		if err := fn(ObjectInfo{Name: entry.Name(), Size: entry.Size(), ModTime: entry.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
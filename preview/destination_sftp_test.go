@@ -0,0 +1,251 @@
+package preview
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an ssh server on a loopback port that accepts one client
+// key and serves sftp from the real filesystem.
+type testSFTPServer struct {
+	addr    string
+	hostKey ssh.PublicKey
+}
+
+func newTestSigner(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, key
+}
+
+func startTestSFTPServer(t *testing.T, clientKey ssh.PublicKey) *testSFTPServer {
+	t.Helper()
+	hostSigner, _ := newTestSigner(t)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSH(conn, config)
+		}
+	}()
+
+	return &testSFTPServer{addr: ln.Addr().String(), hostKey: hostSigner.PublicKey()}
+}
+
+func serveTestSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					_ = channel.Close()
+					return
+				}
+				_ = server.Serve()
+				_ = channel.Close()
+				return
+			}
+		}()
+	}
+}
+
+// newTestSFTPDestination connects to srv with a fresh directory, trusting
+// hostKey for the server.
+func newTestSFTPDestination(t *testing.T, srv *testSFTPServer, clientKey ed25519.PrivateKey, hostKey ssh.PublicKey) (*SFTPDestination, string) {
+	t.Helper()
+	tmp := t.TempDir()
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(tmp, "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	knownHostsPath := filepath.Join(tmp, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, hostKey)
+	if err := os.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(tmp, "media")
+	config, err := url.Parse("sftp://bot@" + srv.addr + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := config.Query()
+	query.Set("key", keyPath)
+	query.Set("known_hosts", knownHostsPath)
+	config.RawQuery = query.Encode()
+
+	dest, err := NewSFTPDestination(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dest.Close() })
+	return dest, dir
+}
+
+func TestSFTPDestination(t *testing.T) {
+	clientSigner, clientKey := newTestSigner(t)
+	srv := startTestSFTPServer(t, clientSigner.PublicKey())
+	dest, dir := newTestSFTPDestination(t, srv, clientKey, srv.hostKey)
+	ctx := context.Background()
+
+	// key auth, and uploading over an existing file replaces it in place
+	if err := dest.Upload(ctx, "abc.mp4", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Upload(ctx, "abc.mp4", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := dest.Download(ctx, "abc.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "second" {
+		t.Errorf("content = %q, want %q", content, "second")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+
+	var listed []string
+	err = dest.List(ctx, func(obj ObjectInfo) error {
+		listed = append(listed, obj.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != "abc.mp4" {
+		t.Errorf("listed = %v, want [abc.mp4]", listed)
+	}
+
+	if err := dest.Delete(ctx, "abc.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := dest.Exists(ctx, "abc.mp4"); ok || err != nil {
+		t.Errorf("Exists after Delete = %v, %v", ok, err)
+	}
+}
+
+func TestSFTPDestinationNotExist(t *testing.T) {
+	clientSigner, clientKey := newTestSigner(t)
+	srv := startTestSFTPServer(t, clientSigner.PublicKey())
+	dest, _ := newTestSFTPDestination(t, srv, clientKey, srv.hostKey)
+	ctx := context.Background()
+
+	if _, err := dest.Download(ctx, "missing.mp4"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Download error = %v, want fs.ErrNotExist", err)
+	}
+	if err := dest.Delete(ctx, "missing.mp4"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Delete error = %v, want fs.ErrNotExist", err)
+	}
+	if ok, err := dest.Exists(ctx, "missing.mp4"); ok || err != nil {
+		t.Errorf("Exists = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestSFTPDestinationHostKeyMismatch(t *testing.T) {
+	clientSigner, clientKey := newTestSigner(t)
+	srv := startTestSFTPServer(t, clientSigner.PublicKey())
+	otherHost, _ := newTestSigner(t)
+	dest, _ := newTestSFTPDestination(t, srv, clientKey, otherHost.PublicKey())
+
+	err := dest.Upload(context.Background(), "abc.mp4", []byte("content"))
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("Upload error = %v, want a known_hosts mismatch", err)
+	}
+}
+
+func TestSFTPDestinationCanceled(t *testing.T) {
+	clientSigner, clientKey := newTestSigner(t)
+	srv := startTestSFTPServer(t, clientSigner.PublicKey())
+	dest, _ := newTestSFTPDestination(t, srv, clientKey, srv.hostKey)
+
+	// connect first so the cancellation hits the transfer itself
+	if err := dest.Upload(context.Background(), "abc.mp4", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dest.Upload(ctx, "def.mp4", make([]byte, megaByte)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Upload error = %v, want context.Canceled", err)
+	}
+	if _, err := dest.Download(ctx, "abc.mp4"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Download error = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,35 @@
+package preview
+
+import (
+	"errors"
+	"net/http"
+)
+
+// These classify why a reupload failed so the bot can tell users something
+// more useful than "it didn't work". Check them with errors.Is; ErrMediaTooLarge
+// and ErrMediaTypeNotAllowed from the media policy are the other two.
+var (
+	ErrMediaUnavailable    = errors.New("media is private or unavailable")
+	ErrLinkNotSupported    = errors.New("link is not supported")
+	ErrUpstreamUnavailable = errors.New("upstream service is unavailable")
+)
+
+// cobaltErrorKinds maps cobalt error code prefixes to the errors above.
+var cobaltErrorKinds = []struct {
+	prefix string
+	err    error
+}{
+	{"error.api.content.too_long", ErrMediaTooLarge},
+	{"error.api.content.", ErrMediaUnavailable},
+	{"error.api.link.", ErrLinkNotSupported},
+	{"error.api.service.unsupported", ErrLinkNotSupported},
+	{"error.api.service.disabled", ErrLinkNotSupported},
+	{"error.api.fetch.", ErrUpstreamUnavailable},
+	{"error.api.rate_exceeded", ErrUpstreamUnavailable},
+}
+
+// isUpstreamFailure reports whether a request failed on the other end: no
+// response at all or a server error.
+func isUpstreamFailure(resp *http.Response) bool {
+	return resp == nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
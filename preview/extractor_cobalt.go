@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"strings"
 )
 
 var _ Extractor = (*CobaltExtractor)(nil)
@@ -70,6 +71,17 @@ func (ce CobaltError) Error() string {
 	return "cobalt error: " + ce.Err.Code
 }
 
+// Is classifies the error code, e.g. error.api.content.post.private matches
+// ErrMediaUnavailable.
+func (ce CobaltError) Is(target error) bool {
+	for _, kind := range cobaltErrorKinds {
+		if strings.HasPrefix(ce.Err.Code, kind.prefix) {
+			return target == kind.err
+		}
+	}
+	return false
+}
+
 type CobaltResponse struct {
 	Status string         `json:"status"` // tunnel / local-processing / redirect / picker / error
 	Url    string         `json:"url"`
@@ -82,7 +94,7 @@ type CobaltPicker struct {
 	Url  string `json:"url"`
 }
 
-func (c *CobaltExtractor) Extract(ctx context.Context, url string) ([]string, error) {
+func (c *CobaltExtractor) Extract(ctx context.Context, url string) (Extraction, error) {
 	var (
 		req     = CobaltRequest{Url: url}
 		headers []string
@@ -94,23 +106,27 @@ func (c *CobaltExtractor) Extract(ctx context.Context, url string) ([]string, er
 		headers = []string{"Authorization", "Api-Key " + c.APIKey}
 	}
 
-	_, value, err := JSONRequest[CobaltResponse, CobaltError](ctx, "POST", c.Endpoint, req, headers...)
+	resp, value, err := JSONRequest[CobaltResponse, CobaltError](ctx, "POST", c.Endpoint, req, headers...)
 	if err != nil {
-		return nil, fmt.Errorf("making cobalt request: %w", err)
+		if isUpstreamFailure(resp) {
+			return Extraction{}, fmt.Errorf("making cobalt request: %w: %w", ErrUpstreamUnavailable, err)
+		}
+		return Extraction{}, fmt.Errorf("making cobalt request: %w", err)
 	}
 
+	var extraction Extraction
 	switch value.Status {
 	case "redirect":
-		return []string{value.Url}, nil
+		extraction.RemoteURLs = []string{value.Url}
 	case "tunnel":
-		return []string{value.Url}, nil
+		extraction.RemoteURLs = []string{value.Url}
 	case "picker":
-		urls := make([]string, len(value.Picker))
+		extraction.RemoteURLs = make([]string, len(value.Picker))
 		for i, p := range value.Picker {
-			urls[i] = p.Url
+			extraction.RemoteURLs[i] = p.Url
 		}
-		return urls, nil
 	default:
-		return nil, fmt.Errorf("unexpected cobalt response type: %s", value.Status)
+		return Extraction{}, fmt.Errorf("unexpected cobalt response type: %s", value.Status)
 	}
+	return extraction, nil
 }
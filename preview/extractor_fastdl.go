@@ -34,6 +34,7 @@ type VidProxyRequest struct {
 
 type VidProxyResponse struct {
 	RemoteURLs []string `json:"remote_urls"`
+	Sensitive  bool     `json:"sensitive"`
 }
 
 type VidProxyError struct {
@@ -44,13 +45,16 @@ func (vpe VidProxyError) Error() string {
 	return vpe.Message
 }
 
-func (fdl *FastDLExtractor) Extract(ctx context.Context, mediaURL string) ([]string, error) {
+func (fdl *FastDLExtractor) Extract(ctx context.Context, mediaURL string) (Extraction, error) {
 	ctx, span := tracer.Start(ctx, "fastdl_extract")
 	defer span.End()
 
-	_, value, err := JSONRequest[VidProxyResponse, VidProxyError](ctx, "POST", fdl.Endpoint, VidProxyRequest{mediaURL})
+	resp, value, err := JSONRequest[VidProxyResponse, VidProxyError](ctx, "POST", fdl.Endpoint, VidProxyRequest{mediaURL})
 	if err != nil {
-		return nil, fmt.Errorf("making fastdl request: %w", err)
+		if isUpstreamFailure(resp) {
+			return Extraction{}, fmt.Errorf("making fastdl request: %w: %w", ErrUpstreamUnavailable, err)
+		}
+		return Extraction{}, fmt.Errorf("making fastdl request: %w", err)
 	}
-	return value.RemoteURLs, nil
+	return Extraction{RemoteURLs: value.RemoteURLs, Sensitive: value.Sensitive}, nil
 }
@@ -0,0 +1,524 @@
+package preview
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkozin/discord-video-preview-bot/web"
+)
+
+// fileServer serves hosted media and falls back to the embedded web assets.
+// Range and conditional requests are handled by http.ServeContent.
+type fileServer struct {
+	files  fs.FS
+	assets fs.FS
+	signer *URLSigner
+	etags  *lru[fileETag]
+
+	mediaMaxAge time.Duration
+	otherMaxAge time.Duration
+	cors        string
+	accessLog   bool
+}
+
+// newFileServer reads the server options from the destination url:
+//
+//	max_age_media=8760h  Cache-Control max-age for video, image and audio files
+//	max_age=1h           Cache-Control max-age for everything else
+//	cors=*               Access-Control-Allow-Origin value
+//	access_log=1         log every request
+//	sign_key=env:NAME    require links signed by URLSigner with this key
+func newFileServer(files fs.FS, config *url.URL) (*fileServer, error) {
+	query := config.Query()
+	srv := &fileServer{
+		files:       files,
+		assets:      web.FS,
+		mediaMaxAge: 365 * 24 * time.Hour,
+		otherMaxAge: time.Hour,
+		cors:        query.Get("cors"),
+		etags:       newLRU[fileETag](maxCachedETags, nil),
+	}
+
+	var err error
+	if raw := query.Get("max_age_media"); raw != "" {
+		if srv.mediaMaxAge, err = time.ParseDuration(raw); err != nil {
+			return nil, fmt.Errorf("parsing max_age_media: %w", err)
+		}
+	}
+	if raw := query.Get("max_age"); raw != "" {
+		if srv.otherMaxAge, err = time.ParseDuration(raw); err != nil {
+			return nil, fmt.Errorf("parsing max_age: %w", err)
+		}
+	}
+	if raw := query.Get("access_log"); raw != "" {
+		if srv.accessLog, err = strconv.ParseBool(raw); err != nil {
+			return nil, fmt.Errorf("parsing access_log: %w", err)
+		}
+	}
+	if query.Has("sign_key") {
+		key, err := secretParam(query, "sign_key")
+		if err != nil {
+			return nil, err
+		}
+		if srv.signer, err = NewURLSigner(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return srv, nil
+}
+
+func (srv *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if srv.accessLog {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		defer func() {
+			slog.Info("http request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.status,
+				"bytes", rec.written,
+				"duration", time.Since(start),
+				"remote", r.RemoteAddr,
+				"user_agent", r.UserAgent(),
+			)
+		}()
+		w = rec
+	}
+
+	if srv.cors != "" {
+		w.Header().Set("Access-Control-Allow-Origin", srv.cors)
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, ETag")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+			w.Header().Set("Access-Control-Allow-Headers", "Range, If-None-Match, If-Range")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	// only plain file names are served, which rules out directory listings,
+	// the sharding directories and in-progress temp files
+	if strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// check signatures before touching the files, so forged links cost
+	// nothing and can't tell which files exist
+	var expires time.Time
+	if srv.signer != nil && !srv.isAsset(name) {
+		var err error
+		expires, err = srv.signer.Verify(name, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	f, asset, err := srv.open(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := contentTypeByName(name)
+	etag, err := srv.etag(r.Context(), name, info, content, asset)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Cache-Control", srv.cacheControl(contentType, expires))
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	if path.Ext(name) == ".json" {
+		header.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			gzipped, err := gzipAll(content)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			header.Set("Content-Encoding", "gzip")
+			header.Set("ETag", strings.TrimSuffix(etag, `"`)+`-gzip"`)
+			http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(gzipped))
+			return
+		}
+	}
+
+	header.Set("ETag", etag)
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// open opens name from the files, or from the web assets when there's no such
+// file, which asset reports.
+func (srv *fileServer) open(ctx context.Context, name string) (f fs.File, asset bool, err error) {
+	f, err = srv.openFile(ctx, name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, false, err
+	}
+	f, err = srv.assets.Open(name)
+	return f, true, err
+}
+
+func (srv *fileServer) openFile(ctx context.Context, name string) (fs.File, error) {
+	if cfs, ok := srv.files.(contextFS); ok {
+		return cfs.OpenContext(ctx, name)
+	}
+	return srv.files.Open(name)
+}
+
+// isAsset reports whether name is one of the embedded web assets, which are
+// public even when links are signed.
+func (srv *fileServer) isAsset(name string) bool {
+	_, err := fs.Stat(srv.assets, name)
+	return err == nil
+}
+
+// maxCachedETags bounds how many file tags the server remembers.
+const maxCachedETags = 4096
+
+// fileETag is the tag of a file as it was when it was looked up.
+type fileETag struct {
+	size     int64
+	modTime  time.Time
+	cachedAt time.Time
+	etag     string
+}
+
+// etag returns a strong validator for name derived from its content, so the
+// same content gets the same tag wherever it's stored. Stored media is tagged
+// with the sha256 the reuploader recorded for it, which is the name of
+// content-addressed files and in the manifest otherwise, so the server doesn't
+// need to read it. Anything else, like the embedded assets and files from
+// before checksums were recorded, is hashed.
+//
+// Tags are remembered until the file changes size or mtime or forget is called,
+// and for files without an mtime for downloadCacheTTL.
+func (srv *fileServer) etag(ctx context.Context, name string, info fs.FileInfo, content io.ReadSeeker, asset bool) (string, error) {
+	if cached, ok := srv.etags.Get(name); ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) &&
+		(!info.ModTime().IsZero() || time.Since(cached.cachedAt) < downloadCacheTTL) {
+		return cached.etag, nil
+	}
+
+	sum, ok := "", false
+	if !asset {
+		sum, ok = srv.recordedChecksum(ctx, name, info.Size())
+	}
+	if !ok {
+		h := sha256.New()
+		if _, err := io.Copy(h, content); err != nil {
+			return "", err
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		sum = hex.EncodeToString(h.Sum(nil)[:16])
+	}
+	etag := `"` + sum + `"`
+	srv.etags.Add(name, fileETag{size: info.Size(), modTime: info.ModTime(), cachedAt: time.Now(), etag: etag}, 1)
+	return etag, nil
+}
+
+// recordedChecksum returns the first half of the sha256 the reuploader
+// recorded for name, in hex like content addresses.
+func (srv *fileServer) recordedChecksum(ctx context.Context, name string, size int64) (string, bool) {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	if isContentAddress(stem) {
+		return stem, true
+	}
+
+	// otherwise named after the media id, with -N for each file of a post
+	mediaID, _, _ := strings.Cut(stem, "-")
+	f, err := srv.openFile(ctx, mediaID+".json")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	var manifest Manifest
+	if err := json.NewDecoder(io.LimitReader(f, megaByte)).Decode(&manifest); err != nil {
+		return "", false
+	}
+	checksum, ok := manifest.Checksums[name]
+	if !ok || checksum.Size != size || len(checksum.SHA256) < 32 {
+		return "", false
+	}
+	return checksum.SHA256[:32], true
+}
+
+// forget drops what the server remembers about name after it was rewritten or
+// deleted.
+func (srv *fileServer) forget(name string) {
+	srv.etags.Remove(name)
+	if dfs, ok := srv.files.(*destinationFS); ok {
+		dfs.forget(name)
+	}
+}
+
+// NewFileHandler serves the files of any destination over http, see
+// newFileServer for the options read from config, and newDestinationFS for
+// how files are fetched.
+func NewFileHandler(dest Destination, config *url.URL) (http.Handler, error) {
+	files, err := newDestinationFS(dest, config)
+	if err != nil {
+		return nil, err
+	}
+	return newFileServer(files, config)
+}
+
+// ServeFiles serves the files of dest on the host of config with the options of
+// NewFileHandler. The listener is bound before it returns and later failures
+// are logged.
+func ServeFiles(dest Destination, config *url.URL) (io.Closer, error) {
+	handler, err := NewFileHandler(dest, config)
+	if err != nil {
+		return nil, err
+	}
+	return startHTTPServer(config.Host, handler, config)
+}
+
+type contextFS interface {
+	OpenContext(ctx context.Context, name string) (fs.File, error)
+}
+
+// downloadCacheTTL is how long a downloaded file is served without asking the
+// destination again. Stored files rarely change, but Refresh rewrites them.
+const downloadCacheTTL = 10 * time.Minute
+
+// destinationFS adapts a Destination to fs.FS by downloading whole files.
+// Downloads are kept for a while, so the range requests of a player seeking
+// through a video don't each download (and decrypt) the file again, and
+// requests for a file that is being downloaded wait for that download.
+type destinationFS struct {
+	dest      Destination
+	downloads *lru[cachedDownload]
+
+	mu       sync.Mutex
+	inflight map[string]*download
+}
+
+type cachedDownload struct {
+	content      []byte
+	downloadedAt time.Time
+}
+
+type download struct {
+	done    chan struct{}
+	content []byte
+	err     error
+}
+
+// newDestinationFS reads its options from the destination url:
+//
+//	download_cache=256MB  memory for recently downloaded files, 0 disables
+func newDestinationFS(dest Destination, config *url.URL) (*destinationFS, error) {
+	size := int64(256 * megaByte)
+	if raw := config.Query().Get("download_cache"); raw != "" {
+		var err error
+		if size, err = parseByteSize(raw); err != nil {
+			return nil, fmt.Errorf("parsing download_cache: %w", err)
+		}
+	}
+	return &destinationFS{
+		dest:      dest,
+		downloads: newLRU[cachedDownload](size, nil),
+		inflight:  map[string]*download{},
+	}, nil
+}
+
+func (dfs *destinationFS) Open(name string) (fs.File, error) {
+	return dfs.OpenContext(context.Background(), name)
+}
+
+func (dfs *destinationFS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	if cached, ok := dfs.downloads.Get(name); ok && time.Since(cached.downloadedAt) < downloadCacheTTL {
+		return newMemFile(name, cached.content, time.Time{}), nil
+	}
+	content, err := dfs.download(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return newMemFile(name, content, time.Time{}), nil
+}
+
+// download fetches name once for every request that wants it at the same time.
+// The download carries on when the request that started it goes away, since
+// others may be waiting for it.
+func (dfs *destinationFS) download(ctx context.Context, name string) ([]byte, error) {
+	dfs.mu.Lock()
+	d, ok := dfs.inflight[name]
+	if !ok {
+		d = &download{done: make(chan struct{})}
+		dfs.inflight[name] = d
+		go func() {
+			d.content, d.err = dfs.dest.Download(context.WithoutCancel(ctx), name)
+			if d.err == nil {
+				dfs.downloads.Add(name, cachedDownload{content: d.content, downloadedAt: time.Now()}, int64(len(d.content)))
+			}
+			dfs.mu.Lock()
+			delete(dfs.inflight, name)
+			dfs.mu.Unlock()
+			close(d.done)
+		}()
+	}
+	dfs.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.content, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// forget drops the download of name after it was rewritten or deleted.
+func (dfs *destinationFS) forget(name string) {
+	dfs.downloads.Remove(name)
+}
+
+// memFile is a read-only fs.File over content held in memory.
+type memFile struct {
+	*bytes.Reader
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func newMemFile(name string, content []byte, modTime time.Time) *memFile {
+	return &memFile{
+		Reader:  bytes.NewReader(content),
+		name:    name,
+		size:    int64(len(content)),
+		modTime: modTime,
+	}
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *memFile) Close() error               { return nil }
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return f.size }
+func (f *memFile) Mode() fs.FileMode  { return 0444 }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return false }
+func (f *memFile) Sys() any           { return nil }
+
+// cacheControl returns the caching policy for a file. Signed links may only be
+// cached until they expire, so caches ask again and get a 403 afterwards.
+func (srv *fileServer) cacheControl(contentType string, expires time.Time) string {
+	maxAge := srv.otherMaxAge
+	if isMediaType(contentType) {
+		maxAge = srv.mediaMaxAge
+	}
+	if !expires.IsZero() {
+		maxAge = max(min(maxAge, time.Until(expires)), 0)
+		return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+	}
+	if isMediaType(contentType) {
+		return fmt.Sprintf("public, max-age=%d, immutable", int(maxAge.Seconds()))
+	}
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
+
+func contentTypeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, ok := typeByExtension[ext]; ok {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+func isMediaType(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/") ||
+		strings.HasPrefix(contentType, "image/") ||
+		strings.HasPrefix(contentType, "audio/")
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(enc, "gzip") && strings.TrimSpace(params) != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipAll(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, r); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,147 @@
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestFileServer returns an fs destination and the server it started, which
+// is called directly rather than over the network.
+func newTestFileServer(t *testing.T, query string) (*FSDestination, *fileServer) {
+	t.Helper()
+	config, err := url.Parse("fs://" + t.TempDir() + "?server=127.0.0.1:0&" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := NewFSDestination(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dest.Close() })
+	return dest, dest.files
+}
+
+func serve(srv http.Handler, path string, header http.Header) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestFileServerRange(t *testing.T) {
+	dest, srv := newTestFileServer(t, "shard=2")
+	if err := dest.Upload(context.Background(), "abcdef.mp4", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serve(srv, "/abcdef.mp4", http.Header{"Range": {"bytes=2-5"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "2345" {
+		t.Errorf("body = %q, want %q", body, "2345")
+	}
+}
+
+func TestFileServerIfNoneMatch(t *testing.T) {
+	dest, srv := newTestFileServer(t, "")
+	ctx := context.Background()
+	if err := dest.Upload(ctx, "abcdef.mp4", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serve(srv, "/abcdef.mp4", nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, etag = %q", resp.StatusCode, etag)
+	}
+
+	resp = serve(srv, "/abcdef.mp4", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotModified)
+	}
+
+	// same size, new content
+	if err := dest.Upload(ctx, "abcdef.mp4", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	resp = serve(srv, "/abcdef.mp4", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status after rewrite = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestFileServerRecordedChecksum(t *testing.T) {
+	dest, srv := newTestFileServer(t, "")
+	ctx := context.Background()
+	if err := dest.Upload(ctx, "abcdef-1.mp4", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// not the real hash, so a matching tag shows the file wasn't hashed
+	sum := strings.Repeat("ab", 32)
+	manifest, _ := json.Marshal(Manifest{
+		Files:     []string{"abcdef-1.mp4"},
+		Checksums: map[string]FileChecksum{"abcdef-1.mp4": {Size: 7, SHA256: sum}},
+	})
+	if err := dest.Upload(ctx, "abcdef.json", manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serve(srv, "/abcdef-1.mp4", nil)
+	if got, want := resp.Header.Get("ETag"), `"`+sum[:32]+`"`; got != want {
+		t.Errorf("ETag = %s, want %s", got, want)
+	}
+}
+
+// countingDestination counts the downloads made through it.
+type countingDestination struct {
+	Destination
+	downloads atomic.Int64
+}
+
+func (d *countingDestination) Download(ctx context.Context, name string) ([]byte, error) {
+	d.downloads.Add(1)
+	return d.Destination.Download(ctx, name)
+}
+
+func TestFileHandlerReusesDownloads(t *testing.T) {
+	config, _ := url.Parse("mem://")
+	mem, err := NewMemDestination(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := &countingDestination{Destination: mem}
+	if err := dest.Upload(context.Background(), "abcdef.mp4", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewFileHandler(dest, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, byteRange := range []string{"bytes=0-3", "bytes=4-7", "bytes=8-"} {
+		resp := serve(srv, "/abcdef.mp4", http.Header{"Range": {byteRange}})
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("%s: status = %d, want %d", byteRange, resp.StatusCode, http.StatusPartialContent)
+		}
+	}
+	// the file itself once, and its manifest (missing) once for the etag
+	if got := dest.downloads.Load(); got != 2 {
+		t.Errorf("downloads = %d, want 2", got)
+	}
+}
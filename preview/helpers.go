@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"net/http"
 	"net/http/cookiejar"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -121,6 +123,12 @@ func validateSimpleFilename(filename string) error {
 
 }
 
+// notExist is the error destinations return for missing files so callers can
+// check for it with errors.Is(err, fs.ErrNotExist).
+func notExist(name string) error {
+	return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+}
+
 func JSONRequest[V any, E error](ctx context.Context, method, url string, body any, headers ...string) (*http.Response, *V, error) {
 	ctx, span := tracer.Start(ctx, "json_request")
 	defer span.End()
@@ -173,3 +181,30 @@ func JSONRequest[V any, E error](ctx context.Context, method, url string, body a
 	}
 	return resp, &valueJSON, nil
 }
+
+// parseByteSize parses sizes like "512", "64KB", "1.5GB" using binary multiples.
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1024 * megaByte},
+		{"MB", megaByte},
+		{"KB", 1024},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,121 @@
+package preview
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a least-recently-used cache bounded by the total size of its entries.
+// It is safe for concurrent use.
+type lru[V any] struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List
+	items   map[string]*list.Element
+
+	// onEvict is called without the lock held for entries pushed out to make room.
+	onEvict func(key string, value V)
+}
+
+type lruItem[V any] struct {
+	key   string
+	value V
+	size  int64
+}
+
+func newLRU[V any](maxSize int64, onEvict func(key string, value V)) *lru[V] {
+	return &lru[V]{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+		onEvict: onEvict,
+	}
+}
+
+func (c *lru[V]) Get(key string) (value V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return value, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruItem[V]).value, true
+}
+
+// Add inserts or replaces key, evicting the least recently used entries until
+// the cache fits. Entries larger than the whole cache are not stored.
+func (c *lru[V]) Add(key string, value V, size int64) bool {
+	if size > c.maxSize {
+		c.Remove(key)
+		return false
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*lruItem[V])
+		c.size += size - item.size
+		item.value, item.size = value, size
+		c.order.MoveToFront(elem)
+	} else {
+		c.items[key] = c.order.PushFront(&lruItem[V]{key: key, value: value, size: size})
+		c.size += size
+	}
+
+	var evicted []*lruItem[V]
+	for c.size > c.maxSize {
+		elem := c.order.Back()
+		item := elem.Value.(*lruItem[V])
+		c.removeElement(elem)
+		evicted = append(evicted, item)
+	}
+	c.mu.Unlock()
+
+	if c.onEvict != nil {
+		for _, item := range evicted {
+			c.onEvict(item.key, item.value)
+		}
+	}
+	return true
+}
+
+func (c *lru[V]) Remove(key string) (value V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return value, false
+	}
+	c.removeElement(elem)
+	return elem.Value.(*lruItem[V]).value, true
+}
+
+// Each calls fn for every entry, most recently used first, without changing
+// their order. fn must not call back into the cache.
+func (c *lru[V]) Each(fn func(key string, value V, size int64) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		item := elem.Value.(*lruItem[V])
+		if !fn(item.key, item.value, item.size) {
+			return
+		}
+	}
+}
+
+func (c *lru[V]) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *lru[V]) removeElement(elem *list.Element) {
+	item := elem.Value.(*lruItem[V])
+	c.order.Remove(elem)
+	delete(c.items, item.key)
+	c.size -= item.size
+}
@@ -0,0 +1,193 @@
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type MigrateOptions struct {
+	// Concurrency is how many manifests are copied at once.
+	Concurrency int
+	// Verify downloads every copied file again and compares it with the
+	// checksum in its manifest, or with the source for files without one.
+	// Files already in the destination are checked the same way.
+	Verify bool
+}
+
+type MigrateStats struct {
+	Manifests int64 // manifests found in the source
+	Copied    int64 // manifests copied along with their files
+	Skipped   int64 // manifests that already existed in the destination
+	Failed    int64
+	Files     int64 // files copied
+	Existing  int64 // files that already existed in the destination
+	Bytes     int64
+}
+
+func (s *MigrateStats) String() string {
+	done := atomic.LoadInt64(&s.Copied) + atomic.LoadInt64(&s.Skipped) + atomic.LoadInt64(&s.Failed)
+	return fmt.Sprintf("%d/%d manifests (copied=%d skipped=%d failed=%d) files=%d existing=%d bytes=%d",
+		done, atomic.LoadInt64(&s.Manifests), atomic.LoadInt64(&s.Copied), atomic.LoadInt64(&s.Skipped),
+		atomic.LoadInt64(&s.Failed), atomic.LoadInt64(&s.Files), atomic.LoadInt64(&s.Existing), atomic.LoadInt64(&s.Bytes))
+}
+
+// Migrate copies every manifest and the files it references from src to dst.
+// Manifests are written after their files, so an interrupted migration is
+// resumed by running it again: manifests already in dst are skipped, and so
+// are files already in dst, like those of a partly copied manifest or blobs
+// shared with one copied before.
+//
+// stats is updated as the migration runs and may be read concurrently.
+func Migrate(ctx context.Context, src, dst Destination, opts MigrateOptions, stats *MigrateStats) error {
+	ctx, span := tracer.Start(ctx, "migrate")
+	defer span.End()
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	var manifests []string
+	err := ListObjects(ctx, src, func(obj ObjectInfo) error {
+		if isManifestName(obj.Name) {
+			manifests = append(manifests, obj.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing source: %w", err)
+	}
+	atomic.StoreInt64(&stats.Manifests, int64(len(manifests)))
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		errs  []error
+		queue = make(chan string)
+	)
+	for range opts.Concurrency {
+		wg.Go(func() {
+			for name := range queue {
+				err := migrateManifest(ctx, src, dst, name, opts, stats)
+				if err != nil {
+					atomic.AddInt64(&stats.Failed, 1)
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", name, err))
+					mu.Unlock()
+				}
+			}
+		})
+	}
+
+	for _, name := range manifests {
+		select {
+		case queue <- name:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+func migrateManifest(ctx context.Context, src, dst Destination, name string, opts MigrateOptions, stats *MigrateStats) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	exists, err := ObjectExists(ctx, dst, name)
+	if err != nil {
+		return fmt.Errorf("checking destination: %w", err)
+	}
+	if exists {
+		atomic.AddInt64(&stats.Skipped, 1)
+		return nil
+	}
+
+	manifestBytes, err := src.Download(ctx, name)
+	if err != nil {
+		return fmt.Errorf("downloading manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("unmarshaling manifest: %w", err)
+	}
+
+	for _, file := range manifest.Files {
+		checksum := manifest.Checksums[file] // zero in manifests from before checksums
+		if err := copyFile(ctx, src, dst, file, checksum, opts.Verify, stats); err != nil {
+			return fmt.Errorf("copying %s: %w", file, err)
+		}
+	}
+
+	if err := copyFile(ctx, src, dst, name, FileChecksum{}, opts.Verify, stats); err != nil {
+		return fmt.Errorf("copying manifest: %w", err)
+	}
+
+	atomic.AddInt64(&stats.Copied, 1)
+	return nil
+}
+
+// copyFile copies name from src to dst unless dst already has it. checksum is
+// what the manifest recorded for the file, zero when it has none.
+func copyFile(ctx context.Context, src, dst Destination, name string, checksum FileChecksum, verify bool, stats *MigrateStats) error {
+	exists, err := ObjectExists(ctx, dst, name)
+	if err != nil {
+		return fmt.Errorf("checking destination: %w", err)
+	}
+	if exists && (!verify || checksum == (FileChecksum{})) {
+		atomic.AddInt64(&stats.Existing, 1)
+		return nil
+	}
+	if exists {
+		copied, err := dst.Download(ctx, name)
+		if err != nil {
+			return fmt.Errorf("downloading for verification: %w", err)
+		}
+		if newFileChecksum(copied) == checksum {
+			atomic.AddInt64(&stats.Existing, 1)
+			return nil
+		}
+		// a bad copy, replace it
+	}
+
+	content, err := src.Download(ctx, name)
+	if err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
+	if checksum == (FileChecksum{}) {
+		checksum = newFileChecksum(content)
+	} else if newFileChecksum(content) != checksum {
+		return errors.New("source doesn't match the checksum in its manifest")
+	}
+
+	if err := dst.Upload(ctx, name, content); err != nil {
+		return fmt.Errorf("uploading: %w", err)
+	}
+
+	if verify {
+		copied, err := dst.Download(ctx, name)
+		if err != nil {
+			return fmt.Errorf("downloading for verification: %w", err)
+		}
+		if newFileChecksum(copied) != checksum {
+			return errors.New("checksum mismatch after upload")
+		}
+	}
+
+	atomic.AddInt64(&stats.Files, 1)
+	atomic.AddInt64(&stats.Bytes, int64(len(content)))
+	return nil
+}
+
+func isManifestName(name string) bool {
+	return strings.HasSuffix(name, ".json")
+}
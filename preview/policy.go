@@ -0,0 +1,152 @@
+package preview
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrMediaTooLarge       = errors.New("media is too large")
+	ErrMediaTypeNotAllowed = errors.New("media type is not allowed")
+)
+
+// MediaPolicyError is returned by transfers that break the media policy. It
+// matches ErrMediaTooLarge or ErrMediaTypeNotAllowed with errors.Is.
+type MediaPolicyError struct {
+	ContentType string
+	Size        int64
+	Limit       int64
+	Err         error
+}
+
+func (e *MediaPolicyError) Error() string {
+	if errors.Is(e.Err, ErrMediaTooLarge) {
+		return fmt.Sprintf("%s: %s is %d bytes, limit is %d bytes", e.Err, e.ContentType, e.Size, e.Limit)
+	}
+	return fmt.Sprintf("%s: %s", e.Err, e.ContentType)
+}
+
+func (e *MediaPolicyError) Unwrap() error {
+	return e.Err
+}
+
+// MediaPolicy maps allowed content types to the largest file accepted for
+// them. Keys may be a full type like "video/mp4" or a wildcard like "image/*".
+// A limit of zero disallows the type.
+type MediaPolicy map[string]int64
+
+var DefaultMediaPolicy = MediaPolicy{
+	"video/mp4":  MaxMediaSize,
+	"video/webm": MaxMediaSize,
+	"video/ogg":  MaxMediaSize,
+	"image/jpeg": MaxMediaSize,
+	"image/png":  MaxMediaSize,
+	"image/gif":  MaxMediaSize,
+	"image/webp": MaxMediaSize,
+	"audio/mpeg": MaxMediaSize,
+	"audio/ogg":  MaxMediaSize,
+	"audio/mp4":  MaxMediaSize,
+	"audio/wav":  MaxMediaSize,
+}
+
+// ParseMediaPolicy parses a comma separated list of type=size entries, e.g.
+// "video/mp4=500MB,image/*=20MB,image/gif". Entries without a size get MaxMediaSize.
+func ParseMediaPolicy(s string) (MediaPolicy, error) {
+	policy := MediaPolicy{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		contentType, rawSize, hasSize := strings.Cut(entry, "=")
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		if !strings.Contains(contentType, "/") {
+			return nil, fmt.Errorf("expecting a content type like video/mp4: %q", contentType)
+		}
+
+		size := int64(MaxMediaSize)
+		if hasSize {
+			var err error
+			size, err = parseByteSize(rawSize)
+			if err != nil {
+				return nil, fmt.Errorf("parsing size for %s: %w", contentType, err)
+			}
+		}
+		policy[contentType] = size
+	}
+	return policy, nil
+}
+
+// DestinationMediaPolicy applies the media_policy option of a destination url
+// on top of base.
+func DestinationMediaPolicy(base MediaPolicy, config *url.URL) (MediaPolicy, error) {
+	raw := config.Query().Get("media_policy")
+	if raw == "" {
+		return base, nil
+	}
+	override, err := ParseMediaPolicy(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing media_policy: %w", err)
+	}
+	return base.Merge(override), nil
+}
+
+// Merge returns a copy of p with the entries of override replacing its own.
+func (p MediaPolicy) Merge(override MediaPolicy) MediaPolicy {
+	merged := make(MediaPolicy, len(p)+len(override))
+	for contentType, size := range p {
+		merged[contentType] = size
+	}
+	for contentType, size := range override {
+		merged[contentType] = size
+	}
+	return merged
+}
+
+// Limit returns the size limit for contentType, preferring an exact match
+// over a wildcard.
+func (p MediaPolicy) Limit(contentType string) (int64, bool) {
+	contentType = strings.ToLower(contentType)
+	if size, ok := p[contentType]; ok {
+		return size, size > 0
+	}
+	major, _, _ := strings.Cut(contentType, "/")
+	if size, ok := p[major+"/*"]; ok {
+		return size, size > 0
+	}
+	return 0, false
+}
+
+// MaxSize is the largest limit of any allowed type, which bounds how much of a
+// response is read before its type is known.
+func (p MediaPolicy) MaxSize() int64 {
+	var largest int64
+	for _, size := range p {
+		largest = max(largest, size)
+	}
+	return largest
+}
+
+func (p MediaPolicy) Check(contentType string, size int64) error {
+	limit, ok := p.Limit(contentType)
+	if !ok {
+		return &MediaPolicyError{ContentType: contentType, Size: size, Err: ErrMediaTypeNotAllowed}
+	}
+	if size > limit {
+		return &MediaPolicyError{ContentType: contentType, Size: size, Limit: limit, Err: ErrMediaTooLarge}
+	}
+	return nil
+}
+
+func (p MediaPolicy) String() string {
+	entries := make([]string, 0, len(p))
+	for contentType, size := range p {
+		entries = append(entries, fmt.Sprintf("%s=%d", contentType, size))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
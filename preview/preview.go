@@ -2,10 +2,13 @@ package preview
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"net/url"
+	"time"
 
 	"go.opentelemetry.io/otel"
 )
@@ -18,18 +21,33 @@ const (
 var (
 	tracer = otel.Tracer("preview")
 
-	allowedMediaTypes = []string{"video/mp4", "image/jpeg", "image/png", "image/jpeg"}
-	extensionByType   = map[string]string{
+	extensionByType = map[string]string{
 		"video/mp4":  ".mp4",
+		"video/webm": ".webm",
+		"video/ogg":  ".ogv",
 		"image/jpeg": ".jpeg",
 		"image/png":  ".png",
 		"image/gif":  ".gif",
+		"image/webp": ".webp",
+		"audio/mpeg": ".mp3",
+		"audio/ogg":  ".ogg",
+		"audio/mp4":  ".m4a",
+		"audio/wav":  ".wav",
 	}
 	typeByExtension = map[string]string{
 		".mp4":  "video/mp4",
+		".webm": "video/webm",
+		".ogv":  "video/ogg",
 		".jpeg": "image/jpeg",
 		".jpg":  "image/jpeg",
 		".gif":  "image/gif",
+		".png":  "image/png",
+		".webp": "image/webp",
+		".mp3":  "audio/mpeg",
+		".ogg":  "audio/ogg",
+		".m4a":  "audio/mp4",
+		".wav":  "audio/wav",
+		".json": "application/json",
 	}
 )
 
@@ -41,14 +59,31 @@ func init() {
 	mime.AddExtensionType(".gif", "image/gif")
 	mime.AddExtensionType(".webp", "image/webp")
 	mime.AddExtensionType(".webm", "video/webm")
+	mime.AddExtensionType(".ogv", "video/ogg")
 	mime.AddExtensionType(".mp3", "audio/mpeg")
 	mime.AddExtensionType(".wav", "audio/wav")
 	mime.AddExtensionType(".ogg", "audio/ogg")
+	mime.AddExtensionType(".m4a", "audio/mp4")
 }
 
 type Extractor interface {
 	IsSupported(mediaURL string) (ok bool)
-	Extract(ctx context.Context, mediaURL string) (remoteURLs []string, err error)
+	Extract(ctx context.Context, mediaURL string) (Extraction, error)
+}
+
+// Extraction is where an extractor found the media of a post.
+type Extraction struct {
+	RemoteURLs []string
+	// Sensitive is set when the platform marks the post as adult or age
+	// restricted. Extractors that can't tell leave it false, and the
+	// Reuploader asks the platform itself where it can, see lookupSensitive.
+	Sensitive bool
+}
+
+// Media is the result of a reupload.
+type Media struct {
+	URLs      []string
+	Sensitive bool
 }
 
 type Destination interface {
@@ -58,6 +93,91 @@ type Destination interface {
 	Download(ctx context.Context, name string) ([]byte, error)
 }
 
+// ObjectInfo describes a file stored in a destination.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Lister is implemented by destinations that can enumerate their files.
+type Lister interface {
+	List(ctx context.Context, fn func(ObjectInfo) error) error
+}
+
+// ListObjects calls fn for every file in dest or the destination it wraps.
+func ListObjects(ctx context.Context, dest Destination, fn func(ObjectInfo) error) error {
+	for d := dest; d != nil; {
+		if l, ok := d.(Lister); ok {
+			return l.List(ctx, fn)
+		}
+		w, ok := d.(interface{ Unwrap() Destination })
+		if !ok {
+			break
+		}
+		d = w.Unwrap()
+	}
+	return fmt.Errorf("%s: %w", dest, errors.ErrUnsupported)
+}
+
+// Deleter is implemented by destinations that can remove files. Deleting a
+// missing file returns an error matching fs.ErrNotExist.
+type Deleter interface {
+	Delete(ctx context.Context, name string) error
+}
+
+// DeleteObject removes name from dest if it supports deleting files.
+func DeleteObject(ctx context.Context, dest Destination, name string) error {
+	if d, ok := dest.(Deleter); ok {
+		return d.Delete(ctx, name)
+	}
+	return fmt.Errorf("%s: %w", dest, errors.ErrUnsupported)
+}
+
+// Exister is implemented by destinations that can check for a file without
+// downloading it.
+type Exister interface {
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+// ObjectExists reports whether name is stored in dest, falling back to a full
+// download for destinations that can't check cheaply.
+func ObjectExists(ctx context.Context, dest Destination, name string) (bool, error) {
+	if e, ok := dest.(Exister); ok {
+		return e.Exists(ctx, name)
+	}
+	_, err := dest.Download(ctx, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PublicURLer is implemented by destinations that know where their files can
+// be fetched from publicly.
+type PublicURLer interface {
+	PublicURL() string
+}
+
+// DestinationPublicURL returns the public url advertised by dest or any
+// destination it wraps.
+func DestinationPublicURL(dest Destination) (string, bool) {
+	for dest != nil {
+		if p, ok := dest.(PublicURLer); ok {
+			return p.PublicURL(), true
+		}
+		w, ok := dest.(interface{ Unwrap() Destination })
+		if !ok {
+			break
+		}
+		dest = w.Unwrap()
+	}
+	return "", false
+}
+
 func NewExtractor(config *url.URL) (ex Extractor, err error) {
 	switch config.Scheme {
 	case "cobalt":
@@ -78,8 +198,46 @@ func NewDestination(ctx context.Context, config *url.URL) (dest Destination, err
 		dest, err = NewFSDestination(ctx, config)
 	case "rclone+webdav":
 		dest, err = NewRCloneWebDAV(ctx, config)
+	case "mem":
+		dest, err = NewMemDestination(ctx, config)
+	case "sftp":
+		dest, err = NewSFTPDestination(ctx, config)
 	default:
 		err = fmt.Errorf("unknown destination: %s", config.Scheme)
 	}
-	return dest, err
+	if err != nil {
+		return nil, err
+	}
+
+	backend := dest
+
+	// the cache sits below encryption so cached files on disk stay encrypted
+	if config.Query().Has("cache") {
+		cached, err := NewCacheDestination(dest, config)
+		if err != nil {
+			_ = dest.Close()
+			return nil, fmt.Errorf("creating cache: %w", err)
+		}
+		dest = cached
+	}
+
+	if config.Query().Has("encrypt_key") {
+		encrypted, err := NewEncryptDestination(dest, config)
+		if err != nil {
+			_ = dest.Close()
+			return nil, fmt.Errorf("creating encryption: %w", err)
+		}
+		if fsDest, ok := backend.(*FSDestination); ok && config.Query().Get("server") != "" {
+			files, err := newDestinationFS(encrypted, config)
+			if err == nil {
+				err = fsDest.startServer(config.Query().Get("server"), files, config)
+			}
+			if err != nil {
+				_ = encrypted.Close()
+				return nil, fmt.Errorf("starting server: %w", err)
+			}
+		}
+		dest = encrypted
+	}
+	return dest, nil
 }
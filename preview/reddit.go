@@ -0,0 +1,88 @@
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/robertkozin/discord-video-preview-bot/tr"
+)
+
+// redditPostPatterns are the links to reddit posts, including share links and
+// short links, which redirect to the post.
+var redditPostPatterns = []string{
+	"reddit.com/r/*/comments/*",
+	"old.reddit.com/r/*/comments/*",
+	"reddit.com/r/*/s/*",
+	"old.reddit.com/r/*/s/*",
+	"redd.it/*",
+	"v.redd.it/*",
+}
+
+type redditListing struct {
+	Data struct {
+		Children []struct {
+			Data struct {
+				Over18 bool `json:"over_18"`
+			} `json:"data"`
+		} `json:"children"`
+	} `json:"data"`
+}
+
+// redditOver18 asks reddit whether a post is marked nsfw.
+func redditOver18(ctx context.Context, postURL string) (_ bool, err error) {
+	ctx, span := tracer.Start(ctx, "reddit_over_18")
+	defer tr.End(span, &err)
+
+	postPath, err := redditPostPath(ctx, postURL)
+	if err != nil {
+		return false, err
+	}
+	jsonURL := "https://www.reddit.com" + strings.TrimSuffix(postPath, "/") + ".json"
+
+	resp, err := httpGet(ctx, jsonURL)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("reddit responded %s", resp.Status)
+	}
+
+	// the post is the first listing, its comments the second
+	var listings []redditListing
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4*megaByte)).Decode(&listings); err != nil {
+		return false, fmt.Errorf("decoding reddit post: %w", err)
+	}
+	if len(listings) == 0 || len(listings[0].Data.Children) == 0 {
+		return false, errors.New("reddit post not found")
+	}
+	return listings[0].Data.Children[0].Data.Over18, nil
+}
+
+// redditPostPath returns the /r/<sub>/comments/<id> path of postURL, following
+// the redirect of share and short links to find it.
+func redditPostPath(ctx context.Context, postURL string) (string, error) {
+	u, err := url.Parse(postURL)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(u.Path, "/comments/") {
+		return u.Path, nil
+	}
+
+	resp, err := httpGet(ctx, postURL)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	if !strings.Contains(resp.Request.URL.Path, "/comments/") {
+		return "", fmt.Errorf("%s doesn't lead to a reddit post", postURL)
+	}
+	return resp.Request.URL.Path, nil
+}
@@ -0,0 +1,207 @@
+package preview
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path"
+	"strings"
+	"time"
+)
+
+type CollectOptions struct {
+	// MaxAge expires manifests created longer ago than this. Zero keeps every
+	// manifest and only removes unreferenced files.
+	MaxAge time.Duration
+	// GracePeriod protects unreferenced files newer than this, which may belong
+	// to a reupload that hasn't written its manifest yet.
+	GracePeriod time.Duration
+}
+
+type CollectStats struct {
+	Manifests        int // manifests kept
+	ExpiredManifests int // manifests deleted for being older than MaxAge
+	BrokenManifests  int // manifests that couldn't be parsed, their files are kept
+	Blobs            int // files still referenced by at least one manifest
+	DeletedBlobs     int
+	DeletedBytes     int64
+}
+
+func (s CollectStats) String() string {
+	return fmt.Sprintf("manifests=%d expired=%d broken=%d blobs=%d deleted=%d (%d bytes)",
+		s.Manifests, s.ExpiredManifests, s.BrokenManifests, s.Blobs, s.DeletedBlobs, s.DeletedBytes)
+}
+
+// errBrokenManifest marks a manifest that was downloaded but can't be parsed.
+var errBrokenManifest = errors.New("broken manifest")
+
+// Collect expires old manifests and then deletes every file that no remaining
+// manifest references. With content-addressed storage several manifests may
+// point at the same blob, so a blob is only deleted once its reference count
+// drops to zero.
+func Collect(ctx context.Context, dest Destination, opts CollectOptions) (CollectStats, error) {
+	ctx, span := tracer.Start(ctx, "collect")
+	defer span.End()
+
+	var (
+		stats      CollectStats
+		objects    []ObjectInfo
+		referenced = map[string]bool{}
+	)
+
+	err := ListObjects(ctx, dest, func(obj ObjectInfo) error {
+		objects = append(objects, obj)
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("listing files: %w", err)
+	}
+
+	for _, obj := range objects {
+		if !isManifestName(obj.Name) {
+			continue
+		}
+
+		manifest, err := readManifest(ctx, dest, obj.Name)
+		if err != nil {
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				continue
+			case errors.Is(err, errBrokenManifest):
+				slog.Warn("keeping files of broken manifest", "manifest", obj.Name, "error", err)
+				stats.BrokenManifests++
+				keepBrokenManifestFiles(referenced, objects, obj.Name)
+				continue
+			}
+			return stats, err
+		}
+
+		if opts.MaxAge > 0 && manifestAge(manifest, obj) > opts.MaxAge {
+			if err := DeleteObject(ctx, dest, obj.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return stats, fmt.Errorf("deleting manifest %s: %w", obj.Name, err)
+			}
+			stats.ExpiredManifests++
+			continue
+		}
+
+		stats.Manifests++
+		for _, file := range manifest.Files {
+			referenced[file] = true
+		}
+	}
+
+	for _, obj := range objects {
+		if referenced[obj.Name] && !isManifestName(obj.Name) {
+			stats.Blobs++
+		}
+	}
+
+	deleted, err := sweepOrphans(ctx, dest, objects, referenced, opts.GracePeriod, nil)
+	for _, obj := range deleted {
+		stats.DeletedBlobs++
+		stats.DeletedBytes += obj.Size
+	}
+	return stats, err
+}
+
+// sweepOrphans deletes the files in objects that are neither manifests nor in
+// referenced and are older than minAge. onOrphan, when set, sees every orphan
+// and decides whether it is deleted.
+//
+// objects may have been listed a while ago, and since then a new manifest can
+// have adopted an existing content-addressed blob without changing its mtime.
+// Manifests that weren't in objects are read again right before deleting so
+// those blobs are kept.
+func sweepOrphans(ctx context.Context, dest Destination, objects []ObjectInfo, referenced map[string]bool, minAge time.Duration, onOrphan func(ObjectInfo) bool) ([]ObjectInfo, error) {
+	known := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		known[obj.Name] = true
+	}
+	referenced = maps.Clone(referenced)
+	err := ListObjects(ctx, dest, func(obj ObjectInfo) error {
+		if known[obj.Name] || !isManifestName(obj.Name) {
+			return nil
+		}
+		manifest, err := readManifest(ctx, dest, obj.Name)
+		if err != nil {
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				return nil
+			case errors.Is(err, errBrokenManifest):
+				slog.Warn("keeping files of broken manifest", "manifest", obj.Name, "error", err)
+				keepBrokenManifestFiles(referenced, objects, obj.Name)
+				return nil
+			}
+			return err
+		}
+		for _, file := range manifest.Files {
+			referenced[file] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing new manifests: %w", err)
+	}
+
+	var deleted []ObjectInfo
+	for _, obj := range objects {
+		if referenced[obj.Name] || isManifestName(obj.Name) {
+			continue
+		}
+		if onOrphan != nil && !onOrphan(obj) {
+			continue
+		}
+		if time.Since(obj.ModTime) < minAge {
+			continue
+		}
+		if err := DeleteObject(ctx, dest, obj.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deleted, fmt.Errorf("deleting %s: %w", obj.Name, err)
+		}
+		deleted = append(deleted, obj)
+	}
+	return deleted, nil
+}
+
+// keepBrokenManifestFiles marks every file the manifest name might list as
+// referenced, since it can't be parsed to tell: the files named after its
+// media id, and any content-addressed blob, which doesn't say who uses it.
+func keepBrokenManifestFiles(referenced map[string]bool, objects []ObjectInfo, name string) {
+	mediaID := strings.TrimSuffix(name, path.Ext(name))
+	for _, obj := range objects {
+		stem := strings.TrimSuffix(obj.Name, path.Ext(obj.Name))
+		if stem == mediaID || strings.HasPrefix(stem, mediaID+"-") || isContentAddress(stem) {
+			referenced[obj.Name] = true
+		}
+	}
+}
+
+// isContentAddress reports whether stem, a file name without its extension,
+// looks like a name from contentAddress.
+func isContentAddress(stem string) bool {
+	_, err := hex.DecodeString(stem)
+	return err == nil && len(stem) == 32
+}
+
+func readManifest(ctx context.Context, dest Destination, name string) (Manifest, error) {
+	manifestBytes, err := dest.Download(ctx, name)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("downloading manifest %s: %w", name, err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("unmarshaling manifest %s: %w: %w", name, errBrokenManifest, err)
+	}
+	return manifest, nil
+}
+
+func manifestAge(manifest Manifest, obj ObjectInfo) time.Duration {
+	if !manifest.CreatedAt.IsZero() {
+		return time.Since(manifest.CreatedAt)
+	}
+	return time.Since(obj.ModTime)
+}
@@ -9,26 +9,60 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"net/http"
+	"mime"
 	"net/url"
-	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robertkozin/discord-video-preview-bot/tr"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Reuploader struct {
 	Extractors  []Extractor
 	Destination Destination
 	PublicURL   string
+
+	// Policy limits which media types are reuploaded and how large they may
+	// be, DefaultMediaPolicy when nil.
+	Policy MediaPolicy
+
+	// ContentAddressed stores files under their content hash instead of the
+	// media id, see Collect for cleaning up blobs no manifest references.
+	ContentAddressed bool
+
+	// Signer, when set, signs every public link so it expires after LinkTTL.
+	Signer  *URLSigner
+	LinkTTL time.Duration
 }
 
 type Manifest struct {
 	CreatedAt time.Time `json:"created_at"`
 	SourceURL string    `json:"source_url"`
 	Files     []string  `json:"files"`
+
+	// Checksums of each file, missing from manifests written before they were recorded.
+	Checksums map[string]FileChecksum `json:"checksums,omitempty"`
+
+	// Sensitive is whether the platform marked the post as nsfw, nil when
+	// that isn't known: manifests written before it was recorded, and posts
+	// whose lookup failed, see Manifest.sensitive.
+	Sensitive *bool `json:"sensitive,omitempty"`
+	// SensitiveLookupFailedAt is when asking the platform last failed, which
+	// holds off the next attempt for sensitiveLookupBackoff.
+	SensitiveLookupFailedAt time.Time `json:"sensitive_lookup_failed_at,omitzero"`
+}
+
+type FileChecksum struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func newFileChecksum(content []byte) FileChecksum {
+	sum := sha256.Sum256(content)
+	return FileChecksum{Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}
 }
 
 func (reup *Reuploader) IsSupported(mediaURL string) bool {
@@ -40,144 +74,292 @@ func (reup *Reuploader) IsSupported(mediaURL string) bool {
 	return false
 }
 
-func (reup *Reuploader) Reupload(ctx context.Context, mediaURL string) ([]string, error) {
+func (reup *Reuploader) Reupload(ctx context.Context, mediaURL string) (Media, error) {
+	return reup.reupload(ctx, mediaURL, false)
+}
+
+// Refresh reuploads mediaURL even if it has already been reuploaded, replacing
+// its manifest.
+func (reup *Reuploader) Refresh(ctx context.Context, mediaURL string) (Media, error) {
+	return reup.reupload(ctx, mediaURL, true)
+}
+
+func (reup *Reuploader) reupload(ctx context.Context, mediaURL string, force bool) (Media, error) {
 	var err error
 	ctx, span := tracer.Start(ctx, "reupload")
 	defer tr.End(span, &err)
 
 	cleanURL, err := cleanURLParams(mediaURL, allowedParams)
 	if err != nil {
-		return nil, err
+		return Media{}, err
 	}
 	mediaID := sha12(cleanURL)
 
-	span.SetAttributes(attribute.String("media_url", mediaURL), attribute.String("clean_url", cleanURL), attribute.String("media_id", mediaID))
+	span.SetAttributes(attribute.String("media_url", mediaURL), attribute.String("clean_url", cleanURL), attribute.String("media_id", mediaID), attribute.Bool("force", force))
 
 	// fast path: video has already been reuploaded
-	manifest, err := reup.getManifest(ctx, mediaID)
-	if err != nil {
-		if !errors.Is(err, fs.ErrNotExist) {
-			return nil, fmt.Errorf("getting manifest: %w", err)
+	if !force {
+		manifest, err := reup.getManifest(ctx, mediaID)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return Media{}, fmt.Errorf("getting manifest: %w", err)
+			}
+		} else {
+			if manifest.sensitiveLookupDue() {
+				// the reply goes out with what's known now
+				go reup.updateSensitive(context.WithoutCancel(ctx), mediaID)
+			}
+			return reup.media(manifest)
 		}
-	} else {
-		permalinks := reup.formatPermalinks(manifest.Files)
-		return permalinks, nil
 	}
 
 	// slow path:
-	remoteURLs, err := reup.extract(ctx, cleanURL)
+	extraction, err := reup.extract(ctx, cleanURL)
 	if err != nil {
-		return nil, fmt.Errorf("extracting: %w", err)
+		return Media{}, fmt.Errorf("extracting: %w", err)
 	}
+	span.SetAttributes(attribute.Bool("sensitive", extraction.Sensitive))
 
-	filenames, err := reup.transferMany(ctx, remoteURLs, mediaID)
+	filenames, checksums, err := reup.transferMany(ctx, extraction.RemoteURLs, mediaID)
 	if err != nil {
-		return nil, fmt.Errorf("reuploading: %w", err)
+		return Media{}, fmt.Errorf("reuploading: %w", err)
 	}
 
-	manifest = Manifest{
+	manifest := Manifest{
 		CreatedAt: time.Now().UTC(),
 		SourceURL: cleanURL,
 		Files:     filenames,
+		Checksums: checksums,
+		Sensitive: &extraction.Sensitive,
+	}
+	if !extraction.Sensitive {
+		// extractors can't always tell
+		lookupSensitive(ctx, &manifest)
 	}
 	err = reup.uploadManifest(ctx, mediaID, manifest)
 	if err != nil {
-		return nil, fmt.Errorf("uploading manifest: %w", err)
+		return Media{}, fmt.Errorf("uploading manifest: %w", err)
 	}
 
-	permalinks := reup.formatPermalinks(manifest.Files)
-	return permalinks, nil
+	return reup.media(manifest)
 }
 
-func (reup *Reuploader) extract(ctx context.Context, mediaURL string) (remoteURLs []string, err error) {
+func (reup *Reuploader) media(manifest Manifest) (Media, error) {
+	urls, err := reup.formatPermalinks(manifest.Files)
+	if err != nil {
+		return Media{}, err
+	}
+	return Media{URLs: urls, Sensitive: manifest.sensitive()}, nil
+}
+
+// sensitiveLookupBackoff is how long a post whose nsfw lookup failed waits
+// before it's asked about again.
+const sensitiveLookupBackoff = time.Hour
+
+// sensitive reports whether the media should be treated as nsfw. Posts the
+// platform could still be asked about count as nsfw until it answers, others,
+// like those from before this was recorded, as not.
+func (m Manifest) sensitive() bool {
+	if m.Sensitive != nil {
+		return *m.Sensitive
+	}
+	return simpleURLMatch(m.SourceURL, redditPostPatterns)
+}
+
+// sensitiveLookupDue reports whether the platform should be asked whether the
+// post is nsfw, which is only worth retrying every sensitiveLookupBackoff.
+func (m Manifest) sensitiveLookupDue() bool {
+	return m.Sensitive == nil && simpleURLMatch(m.SourceURL, redditPostPatterns) &&
+		time.Since(m.SensitiveLookupFailedAt) > sensitiveLookupBackoff
+}
+
+// lookupSensitive asks the platform of the post whether it is nsfw, for the
+// platforms that answer that separately from their media, and records the
+// answer or the failure in manifest.
+func lookupSensitive(ctx context.Context, manifest *Manifest) {
+	sensitive := false
+	if simpleURLMatch(manifest.SourceURL, redditPostPatterns) {
+		var err error
+		if sensitive, err = redditOver18(ctx, manifest.SourceURL); err != nil {
+			manifest.SensitiveLookupFailedAt = time.Now().UTC()
+			return
+		}
+	}
+	manifest.Sensitive = &sensitive
+	manifest.SensitiveLookupFailedAt = time.Time{}
+}
+
+// sensitiveLookups holds the manifests whose post is being looked up, so a
+// burst of requests for one post asks the platform once.
+var sensitiveLookups sync.Map
+
+// updateSensitive looks up whether the post of mediaID is nsfw and saves the
+// outcome in its manifest.
+func (reup *Reuploader) updateSensitive(ctx context.Context, mediaID string) {
+	var err error
+	ctx, span := tracer.Start(ctx, "update_sensitive", trace.WithAttributes(attribute.String("media_id", mediaID)))
+	defer tr.End(span, &err)
+
+	key := reup.Destination.String() + "/" + mediaID
+	if _, busy := sensitiveLookups.LoadOrStore(key, true); busy {
+		return
+	}
+	defer sensitiveLookups.Delete(key)
+
+	// reread it in case it was refreshed in the meantime
+	manifest, err := reup.getManifest(ctx, mediaID)
+	if err != nil || !manifest.sensitiveLookupDue() {
+		return
+	}
+	lookupSensitive(ctx, &manifest)
+	err = reup.uploadManifest(ctx, mediaID, manifest)
+}
+
+func (reup *Reuploader) extract(ctx context.Context, mediaURL string) (extraction Extraction, err error) {
 	ctx, span := tracer.Start(ctx, "extract")
 	defer tr.End(span, &err)
 
 	errs := []error{}
 	for _, extractor := range reup.Extractors {
 		if extractor.IsSupported(mediaURL) {
-			remoteURLs, err = extractor.Extract(ctx, mediaURL)
+			extraction, err = extractor.Extract(ctx, mediaURL)
 			if err != nil {
 				errs = append(errs, err)
 				continue
 			}
-			return remoteURLs, nil
+			return extraction, nil
 		}
 	}
 
 	if len(errs) == 0 {
-		return nil, fmt.Errorf("no extractors matching: %s", mediaURL)
+		return Extraction{}, fmt.Errorf("no extractors matching: %s: %w", mediaURL, ErrLinkNotSupported)
 	}
 
-	return nil, fmt.Errorf("extracting media: %s: %w", mediaURL, errors.Join(errs...))
+	return Extraction{}, fmt.Errorf("extracting media: %s: %w", mediaURL, errors.Join(errs...))
 }
 
-func (reup *Reuploader) transferMany(ctx context.Context, remoteURLs []string, mediaID string) ([]string, error) {
+func (reup *Reuploader) transferMany(ctx context.Context, remoteURLs []string, mediaID string) ([]string, map[string]FileChecksum, error) {
 	ctx, span := tracer.Start(ctx, "transfer_many")
 	defer span.End()
 
+	checksums := make(map[string]FileChecksum, len(remoteURLs))
+
 	if len(remoteURLs) == 1 {
 		name := mediaID
-		filename, err := reup.transfer(ctx, remoteURLs[0], name)
+		filename, checksum, err := reup.transfer(ctx, remoteURLs[0], name)
 		if err != nil {
-			return nil, fmt.Errorf("transfering from %s: %w", remoteURLs[0], err)
+			return nil, nil, fmt.Errorf("transfering from %s: %w", remoteURLs[0], err)
 		}
-		return []string{filename}, nil
+		checksums[filename] = checksum
+		return []string{filename}, checksums, nil
 	}
 
 	filenames := make([]string, 0, len(remoteURLs))
+	var errs []error
 	for i, remoteURL := range remoteURLs {
 		name := fmt.Sprintf("%s-%d", mediaID, i+1)
-		filename, err := reup.transfer(ctx, remoteURL, name)
+		filename, checksum, err := reup.transfer(ctx, remoteURL, name)
 		if err != nil {
-			continue // TODO, continue but keep track of errors, error if all are errors
+			// skip files that fail, as long as at least one makes it
+			errs = append(errs, fmt.Errorf("transfering from %s: %w", remoteURL, err))
+			continue
 		}
 		filenames = append(filenames, filename)
+		checksums[filename] = checksum
+	}
+
+	if len(filenames) == 0 {
+		return nil, nil, errors.Join(errs...)
 	}
 
-	return filenames, nil
+	return filenames, checksums, nil
 }
 
-func (reup *Reuploader) transfer(ctx context.Context, remoteURL string, name string) (string, error) {
+func (reup *Reuploader) transfer(ctx context.Context, remoteURL string, name string) (string, FileChecksum, error) {
 	ctx, span := tracer.Start(ctx, "transfer_one")
 	defer span.End()
 
 	resp, err := httpGet(ctx, remoteURL)
 	if err != nil {
-		return "", fmt.Errorf("fetching remote url: %w", err)
+		return "", FileChecksum{}, fmt.Errorf("fetching remote url: %w: %w", ErrUpstreamUnavailable, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("unexpected error fetching remote url: %s", resp.Status)
+		kind := ErrMediaUnavailable
+		if isUpstreamFailure(resp) {
+			kind = ErrUpstreamUnavailable
+		}
+		return "", FileChecksum{}, fmt.Errorf("unexpected error fetching remote url: %s: %w", resp.Status, kind)
 	}
 
-	if resp.ContentLength > MaxMediaSize {
-		return "", fmt.Errorf("remote media is too large: %dbytes", resp.ContentLength)
+	policy := reup.mediaPolicy()
+	maxSize := policy.MaxSize()
+	if resp.ContentLength > maxSize {
+		return "", FileChecksum{}, &MediaPolicyError{ContentType: resp.Header.Get("Content-Type"), Size: resp.ContentLength, Limit: maxSize, Err: ErrMediaTooLarge}
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	// read one byte past the limit so oversized bodies without a content length are caught
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
 	if err != nil {
-		return "", fmt.Errorf("downloading media to memory: %w", err)
+		return "", FileChecksum{}, fmt.Errorf("downloading media to memory: %w", err)
 	} else if body == nil || len(body) == 0 {
-		return "", fmt.Errorf("expecting media response body to not be empty")
+		return "", FileChecksum{}, fmt.Errorf("expecting media response body to not be empty")
 	}
 
-	contentType := http.DetectContentType(body)
-	if !slices.Contains(allowedMediaTypes, contentType) {
-		return "", fmt.Errorf("expecting allowed content type: %s", contentType)
+	contentType := detectContentType(body)
+	if err := policy.Check(contentType, int64(len(body))); err != nil {
+		return "", FileChecksum{}, err
 	}
 
-	ext := extensionByType[contentType]
+	ext := extensionOf(contentType)
+	checksum := newFileChecksum(body)
 
 	filename := name + ext
+	if reup.ContentAddressed {
+		filename = contentAddress(checksum) + ext
+
+		exists, err := ObjectExists(ctx, reup.Destination, filename)
+		if err != nil {
+			return "", FileChecksum{}, fmt.Errorf("checking for existing blob: %w", err)
+		}
+		span.SetAttributes(attribute.Bool("blob_exists", exists))
+		if exists {
+			return filename, checksum, nil
+		}
+	}
 
 	err = reup.Destination.Upload(ctx, filename, body)
 	if err != nil {
-		return "", fmt.Errorf("uploading: %w", err)
+		return "", FileChecksum{}, fmt.Errorf("uploading: %w", err)
 	}
 
-	return filename, nil
+	return filename, checksum, nil
+}
+
+// extensionOf returns the file extension for contentType, asking the mime
+// package about types a custom policy allows beyond the ones we know.
+func extensionOf(contentType string) string {
+	if ext, ok := extensionByType[contentType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// contentAddress names a blob after its content, so identical media reached
+// through different urls is only stored once.
+func contentAddress(checksum FileChecksum) string {
+	return checksum.SHA256[:32]
+}
+
+func (reup *Reuploader) mediaPolicy() MediaPolicy {
+	if reup.Policy == nil {
+		return DefaultMediaPolicy
+	}
+	return reup.Policy
 }
 
 func (reup *Reuploader) getManifest(ctx context.Context, mediaID string) (Manifest, error) {
@@ -213,12 +395,27 @@ func (reup *Reuploader) uploadManifest(ctx context.Context, mediaID string, mani
 	return nil
 }
 
-func (reup *Reuploader) formatPermalinks(files []string) []string {
+// formatPermalinks returns the public links of files. An unsigned link would
+// be refused by a server that checks signatures, so signing must work.
+func (reup *Reuploader) formatPermalinks(files []string) ([]string, error) {
 	permalinks := make([]string, len(files))
 	for i, file := range files {
 		permalinks[i] = urlCat(reup.PublicURL, file)
+		if reup.Signer != nil {
+			signed, err := reup.Signer.Sign(permalinks[i], reup.LinkTTL)
+			if err != nil {
+				return nil, fmt.Errorf("signing link: %w", err)
+			}
+			permalinks[i] = signed
+		}
 	}
-	return permalinks
+	return permalinks, nil
+}
+
+// CleanURL returns mediaURL without its tracking parameters, the form media is
+// stored under.
+func CleanURL(mediaURL string) (string, error) {
+	return cleanURLParams(mediaURL, allowedParams)
 }
 
 func urlCat(a, b string) string {
@@ -0,0 +1,100 @@
+package preview
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+)
+
+// Tenant identifies who a reupload is for. Either field may be empty.
+type Tenant struct {
+	GuildID string
+	APIKey  string
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context that routes reuploads for tenant.
+func WithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func TenantFromContext(ctx context.Context) Tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(Tenant)
+	return tenant
+}
+
+// Router sends each reupload to the Reuploader configured for its tenant, so
+// one bot can keep several communities' media on separate destinations. Each
+// Reuploader only looks for manifests in its own destination, so the same link
+// posted in two guilds is reuploaded once per destination.
+//
+// An API key route wins over a guild route, and Default handles the rest.
+type Router struct {
+	Default *Reuploader
+	Guilds  map[string]*Reuploader
+	APIKeys map[string]*Reuploader
+}
+
+// Route returns the Reuploader for the tenant in ctx.
+func (r *Router) Route(ctx context.Context) *Reuploader {
+	tenant := TenantFromContext(ctx)
+	if reup, ok := r.APIKeys[tenant.APIKey]; ok && tenant.APIKey != "" {
+		return reup
+	}
+	if reup, ok := r.Guilds[tenant.GuildID]; ok && tenant.GuildID != "" {
+		return reup
+	}
+	return r.Default
+}
+
+// HasAPIKey reports whether key is routed. Keys are compared in constant time
+// since they are secrets.
+func (r *Router) HasAPIKey(key string) bool {
+	found := false
+	for known := range r.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(key)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// IsSupported reports whether the default route can extract mediaURL. Routes
+// share their extractors, so the answer is the same for every tenant.
+func (r *Router) IsSupported(mediaURL string) bool {
+	return r.Default.IsSupported(mediaURL)
+}
+
+func (r *Router) Reupload(ctx context.Context, mediaURL string) (Media, error) {
+	return r.Route(ctx).Reupload(ctx, mediaURL)
+}
+
+func (r *Router) Refresh(ctx context.Context, mediaURL string) (Media, error) {
+	return r.Route(ctx).Refresh(ctx, mediaURL)
+}
+
+// Destinations returns every distinct destination, the default one first.
+func (r *Router) Destinations() []Destination {
+	dests := []Destination{r.Default.Destination}
+	seen := map[Destination]bool{r.Default.Destination: true}
+	for _, routes := range []map[string]*Reuploader{r.Guilds, r.APIKeys} {
+		for _, reup := range routes {
+			if !seen[reup.Destination] {
+				seen[reup.Destination] = true
+				dests = append(dests, reup.Destination)
+			}
+		}
+	}
+	return dests
+}
+
+// Close closes the destinations of every route except the default one, which
+// belongs to whoever created the Router.
+func (r *Router) Close() error {
+	var errs []error
+	for _, dest := range r.Destinations()[1:] {
+		errs = append(errs, dest.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,157 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+type ScrubOptions struct {
+	// Verify downloads every referenced file to check its sha256, otherwise
+	// only existence and (when recorded) size are checked.
+	Verify bool
+	// Repair reuploads the source of every manifest with missing or corrupt
+	// files. It requires Reuploader.
+	Repair     bool
+	Reuploader *Reuploader
+	// DeleteOrphans removes files that no manifest references and that are
+	// older than OrphanAge, which protects reuploads still in progress.
+	DeleteOrphans bool
+	OrphanAge     time.Duration
+}
+
+type ScrubReport struct {
+	Manifests int
+	Files     int
+
+	Missing  []string // files referenced by a manifest but not stored
+	Corrupt  []string // files whose size or checksum doesn't match the manifest
+	Broken   []string // manifests with missing or corrupt files, or that can't be parsed
+	Orphans  []string // files no manifest references
+	Repaired []string // manifests rewritten by Refresh
+	Deleted  []string // orphans removed
+}
+
+func (r *ScrubReport) String() string {
+	return fmt.Sprintf("manifests=%d files=%d missing=%d corrupt=%d broken=%d orphans=%d repaired=%d deleted=%d",
+		r.Manifests, r.Files, len(r.Missing), len(r.Corrupt), len(r.Broken), len(r.Orphans), len(r.Repaired), len(r.Deleted))
+}
+
+// Scrub checks that every file listed in a manifest exists and is intact and
+// finds stored files that no manifest references.
+func Scrub(ctx context.Context, dest Destination, opts ScrubOptions) (*ScrubReport, error) {
+	ctx, span := tracer.Start(ctx, "scrub")
+	defer span.End()
+
+	if opts.Repair && opts.Reuploader == nil {
+		return nil, errors.New("expecting a reuploader to repair manifests")
+	}
+
+	objects := map[string]ObjectInfo{}
+	err := ListObjects(ctx, dest, func(obj ObjectInfo) error {
+		objects[obj.Name] = obj
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+
+	report := &ScrubReport{}
+	referenced := map[string]bool{}
+	var repair []string // source urls
+
+	for name := range objects {
+		if !isManifestName(name) {
+			continue
+		}
+		report.Manifests++
+
+		manifest, err := readManifest(ctx, dest, name)
+		if err != nil {
+			if errors.Is(err, errBrokenManifest) {
+				report.Broken = append(report.Broken, name)
+				keepBrokenManifestFiles(referenced, slices.Collect(maps.Values(objects)), name)
+				continue
+			}
+			return nil, err
+		}
+
+		broken := false
+		for _, file := range manifest.Files {
+			report.Files++
+			referenced[file] = true
+
+			obj, ok := objects[file]
+			if !ok {
+				report.Missing = append(report.Missing, file)
+				broken = true
+				continue
+			}
+
+			ok, err := checkFile(ctx, dest, obj, manifest.Checksums, opts.Verify)
+			if err != nil {
+				return nil, fmt.Errorf("checking %s: %w", file, err)
+			}
+			if !ok {
+				report.Corrupt = append(report.Corrupt, file)
+				broken = true
+			}
+		}
+
+		if broken {
+			report.Broken = append(report.Broken, name)
+			if manifest.SourceURL != "" {
+				repair = append(repair, manifest.SourceURL)
+			}
+		}
+	}
+
+	deleted, err := sweepOrphans(ctx, dest, slices.Collect(maps.Values(objects)), referenced, opts.OrphanAge, func(obj ObjectInfo) bool {
+		report.Orphans = append(report.Orphans, obj.Name)
+		return opts.DeleteOrphans
+	})
+	for _, obj := range deleted {
+		report.Deleted = append(report.Deleted, obj.Name)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	if opts.Repair {
+		var errs []error
+		for _, sourceURL := range repair {
+			if _, err := opts.Reuploader.Refresh(ctx, sourceURL); err != nil {
+				errs = append(errs, fmt.Errorf("repairing %s: %w", sourceURL, err))
+				continue
+			}
+			report.Repaired = append(report.Repaired, sourceURL)
+		}
+		if len(errs) > 0 {
+			return report, errors.Join(errs...)
+		}
+	}
+
+	return report, nil
+}
+
+func checkFile(ctx context.Context, dest Destination, obj ObjectInfo, checksums map[string]FileChecksum, verify bool) (bool, error) {
+	want, ok := checksums[obj.Name]
+	if !ok {
+		return true, nil
+	}
+	if obj.Size != want.Size {
+		return false, nil
+	}
+	if !verify {
+		return true, nil
+	}
+
+	content, err := dest.Download(ctx, obj.Name)
+	if err != nil {
+		return false, err
+	}
+	return newFileChecksum(content) == want, nil
+}
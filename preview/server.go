@@ -0,0 +1,108 @@
+package preview
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpServer is an http.Server whose listener is bound before it is returned,
+// so bind errors reach the caller instead of a background goroutine.
+type httpServer struct {
+	server   *http.Server
+	listener net.Listener
+	done     chan struct{}
+}
+
+// startHTTPServer listens on addr, which is either host:port or unix:/path/to.sock.
+// TLS is enabled when the tls_cert and tls_key query options are set.
+func startHTTPServer(addr string, handler http.Handler, config *url.URL) (*httpServer, error) {
+	query := config.Query()
+	srv := &httpServer{
+		server: &http.Server{
+			Handler: handler,
+
+			ReadHeaderTimeout:            5 * time.Second,
+			DisableGeneralOptionsHandler: true,
+		},
+		done: make(chan struct{}),
+	}
+
+	certFile, keyFile := query.Get("tls_cert"), query.Get("tls_key")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("expecting both tls_cert and tls_key to be set")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls key pair: %w", err)
+		}
+		srv.server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+		// a socket left behind by an unclean shutdown would make Listen fail,
+		// but one that still accepts connections belongs to someone else
+		if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+			if conn, err := net.Dial("unix", path); err == nil {
+				_ = conn.Close()
+				return nil, fmt.Errorf("listening on %s: socket is in use", path)
+			}
+			_ = os.Remove(path)
+		}
+	}
+
+	var err error
+	srv.listener, err = net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	srv.server.Addr = srv.listener.Addr().String()
+
+	go func() {
+		defer close(srv.done)
+		var err error
+		if srv.server.TLSConfig != nil {
+			err = srv.server.ServeTLS(srv.listener, "", "")
+		} else {
+			err = srv.server.Serve(srv.listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("http server stopped", "addr", srv.server.Addr, "error", err)
+		}
+	}()
+
+	return srv, nil
+}
+
+func (srv *httpServer) String() string {
+	scheme := "http"
+	if srv.server.TLSConfig != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, srv.listener.Addr())
+}
+
+// Close gracefully shuts the server down and waits for it to stop serving.
+func (srv *httpServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := srv.server.Shutdown(ctx)
+	<-srv.done
+	return err
+}
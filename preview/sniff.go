@@ -0,0 +1,92 @@
+package preview
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"slices"
+)
+
+// detectContentType extends http.DetectContentType with the media formats it
+// misses or only partly recognizes: mp4 files with brands other than "mp4*",
+// m4a audio, ogg audio and mp3 files without an ID3 tag.
+func detectContentType(data []byte) string {
+	if contentType, ok := sniffISOBMFF(data); ok {
+		return contentType
+	}
+
+	if bytes.HasPrefix(data, []byte("OggS")) {
+		return sniffOgg(data)
+	}
+
+	if isMP3Frame(data) {
+		return "audio/mpeg"
+	}
+
+	switch contentType := http.DetectContentType(data); contentType {
+	case "audio/wave":
+		return "audio/wav"
+	default:
+		return contentType
+	}
+}
+
+var (
+	videoBrands = []string{"isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "M4V ", "M4VH", "M4VP", "dash", "mmp4", "MSNV", "f4v "}
+	audioBrands = []string{"M4A ", "M4B ", "F4A "}
+)
+
+// sniffISOBMFF looks at the major and compatible brands of an ftyp box.
+func sniffISOBMFF(data []byte) (string, bool) {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return "", false
+	}
+
+	boxSize := int(binary.BigEndian.Uint32(data[:4]))
+	if boxSize < 16 || boxSize > len(data) || boxSize%4 != 0 {
+		boxSize = min(len(data), 64) &^ 3
+	}
+
+	brands := []string{string(data[8:12])}
+	for i := 16; i+4 <= boxSize; i += 4 {
+		brands = append(brands, string(data[i:i+4]))
+	}
+
+	// the major brand decides, compatible brands are only a fallback
+	for _, brand := range brands {
+		switch {
+		case slices.Contains(audioBrands, brand):
+			return "audio/mp4", true
+		case slices.Contains(videoBrands, brand), brand[:3] == "mp4":
+			return "video/mp4", true
+		}
+	}
+	return "", false
+}
+
+// sniffOgg tells audio from video by the codec of the first logical stream.
+func sniffOgg(data []byte) string {
+	head := data[:min(len(data), 512)]
+	switch {
+	case bytes.Contains(head, []byte("\x80theora")):
+		return "video/ogg"
+	default:
+		return "audio/ogg"
+	}
+}
+
+// isMP3Frame matches an MPEG audio layer III frame header.
+func isMP3Frame(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("ID3")) {
+		return true
+	}
+	if len(data) < 4 {
+		return false
+	}
+	sync := data[0] == 0xFF && data[1]&0xE0 == 0xE0
+	version := (data[1] >> 3) & 0x03 // 01 is reserved
+	layer := (data[1] >> 1) & 0x03   // 01 is layer III
+	bitrate := data[2] >> 4          // 1111 is invalid
+	sampleRate := (data[2] >> 2) & 0x03
+	return sync && version != 0x01 && layer == 0x01 && bitrate != 0x0F && sampleRate != 0x03
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/robertkozin/discord-video-preview-bot/preview"
+)
+
+// routesConfig is the file named by ROUTES_CONFIG:
+//
+//	{
+//	  "routes": [
+//	    {
+//	      "guilds": ["123456789012345678"],
+//	      "api_keys": ["secret-key"],
+//	      "destination": "b2://key:secret@their-bucket",
+//	      "public_url": "https://media.example.com"
+//	    }
+//	  ]
+//	}
+//
+// Routes share the extractors and settings of the default destination.
+// public_url may be left out when the destination knows its own.
+//
+// PROXY only serves the default destination, so a route whose files need
+// serving (signed links, encryption) names its own server in "proxy", which
+// takes the same options as PROXY, and a public_url pointing at it.
+type routesConfig struct {
+	Routes []routeConfig `json:"routes"`
+}
+
+type routeConfig struct {
+	Guilds      []string `json:"guilds"`
+	APIKeys     []string `json:"api_keys"`
+	Destination string   `json:"destination"`
+	PublicURL   string   `json:"public_url"`
+	Proxy       string   `json:"proxy"`
+}
+
+// routes is the router built from a routesConfig along with the proxies its
+// routes serve their files from.
+type routes struct {
+	*preview.Router
+	proxies []io.Closer
+}
+
+func (r *routes) Close() error {
+	var errs []error
+	for _, proxy := range r.proxies {
+		errs = append(errs, proxy.Close())
+	}
+	errs = append(errs, r.Router.Close())
+	return errors.Join(errs...)
+}
+
+// newRouter builds a router around base with the routes from path. On error
+// the destinations opened so far are closed again.
+func newRouter(ctx context.Context, args Args, path string, base *preview.Reuploader) (_ *routes, err error) {
+	router := &routes{Router: &preview.Router{
+		Default: base,
+		Guilds:  map[string]*preview.Reuploader{},
+		APIKeys: map[string]*preview.Reuploader{},
+	}}
+	if path == "" {
+		return router, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading routes: %w", err)
+	}
+	var config routesConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("parsing routes: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = router.Close()
+		}
+	}()
+
+	for i, route := range config.Routes {
+		if len(route.Guilds) == 0 && len(route.APIKeys) == 0 {
+			return nil, fmt.Errorf("route %d: expecting at least one guild or api key", i+1)
+		}
+		for _, guildID := range route.Guilds {
+			if _, ok := router.Guilds[guildID]; ok {
+				return nil, fmt.Errorf("route %d: guild %s is already routed", i+1, guildID)
+			}
+		}
+		for _, key := range route.APIKeys {
+			if _, ok := router.APIKeys[key]; ok {
+				return nil, fmt.Errorf("route %d: api key is already routed", i+1)
+			}
+		}
+
+		reup, err := newRoute(ctx, args, route, base)
+		if err != nil {
+			return nil, fmt.Errorf("creating route %d: %w", i+1, err)
+		}
+		if reup.proxy != nil {
+			router.proxies = append(router.proxies, reup.proxy)
+		}
+		for _, guildID := range route.Guilds {
+			router.Guilds[guildID] = reup.Reuploader
+		}
+		for _, key := range route.APIKeys {
+			router.APIKeys[key] = reup.Reuploader
+		}
+	}
+
+	return router, nil
+}
+
+type route struct {
+	*preview.Reuploader
+	proxy io.Closer
+}
+
+func newRoute(ctx context.Context, args Args, config routeConfig, base *preview.Reuploader) (_ route, err error) {
+	destURL, err := url.Parse(config.Destination)
+	if err != nil {
+		return route{}, fmt.Errorf("parsing destination: %w", err)
+	}
+
+	var proxyURL *url.URL
+	if config.Proxy != "" {
+		if config.PublicURL == "" {
+			return route{}, errors.New("expecting a public_url for the proxy")
+		}
+		if proxyURL, err = url.Parse(config.Proxy); err != nil {
+			return route{}, fmt.Errorf("parsing proxy: %w", err)
+		}
+	}
+
+	policy, err := newMediaPolicy(args, destURL)
+	if err != nil {
+		return route{}, err
+	}
+
+	dest, err := preview.NewDestination(ctx, destURL)
+	if err != nil {
+		return route{}, fmt.Errorf("creating destination: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = dest.Close()
+		}
+	}()
+
+	publicURL := config.PublicURL
+	if publicURL == "" {
+		var ok bool
+		if publicURL, ok = preview.DestinationPublicURL(dest); !ok {
+			return route{}, errors.New("expecting a public_url for the destination")
+		}
+	}
+
+	var proxy io.Closer
+	if proxyURL != nil {
+		if proxy, err = preview.ServeFiles(dest, proxyURL); err != nil {
+			return route{}, fmt.Errorf("starting proxy: %w", err)
+		}
+	}
+
+	reup := *base
+	reup.Destination = dest
+	reup.PublicURL = publicURL
+	reup.Policy = policy
+	return route{Reuploader: &reup, proxy: proxy}, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/robertkozin/discord-video-preview-bot/preview"
+)
+
+// runScrub checks the configured DESTINATION for missing, corrupt and orphaned
+// files. Repairs reupload from the manifest's source url using EXTRACTORS.
+func runScrub(ctx context.Context, argv []string) error {
+	flags := flag.NewFlagSet("scrub", flag.ContinueOnError)
+	dest := flags.String("dest", "", "destination url (defaults to DESTINATION)")
+	verify := flags.Bool("verify", false, "download every file and compare checksums")
+	repair := flags.Bool("repair", false, "reupload manifests with missing or corrupt files")
+	deleteOrphans := flags.Bool("delete-orphans", false, "delete files no manifest references")
+	orphanAge := flags.Duration("orphan-age", time.Hour, "only delete orphans older than this")
+	verbose := flags.Bool("v", false, "print every problem found")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+
+	args, err := parseArgs()
+	if err != nil {
+		return fmt.Errorf("parsing args: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	destURL := args.Destination.String()
+	if *dest != "" {
+		destURL = *dest
+	}
+	d, err := openDestination(ctx, destURL)
+	if err != nil {
+		return fmt.Errorf("opening destination: %w", err)
+	}
+	defer d.Close()
+
+	opts := preview.ScrubOptions{
+		Verify:        *verify,
+		Repair:        *repair,
+		DeleteOrphans: *deleteOrphans,
+		OrphanAge:     *orphanAge,
+	}
+	if *repair {
+		extractors, err := newExtractors(args)
+		if err != nil {
+			return err
+		}
+		destConfig, _ := url.Parse(destURL)
+		policy, err := newMediaPolicy(args, destConfig)
+		if err != nil {
+			return err
+		}
+		opts.Reuploader = &preview.Reuploader{
+			Extractors:  extractors,
+			Destination: d,
+			Policy:      policy,
+		}
+	}
+
+	fmt.Printf("scrubbing %s\n", d)
+	report, err := preview.Scrub(ctx, d, opts)
+	if report != nil {
+		if *verbose {
+			printNames("missing", report.Missing)
+			printNames("corrupt", report.Corrupt)
+			printNames("broken", report.Broken)
+			printNames("orphan", report.Orphans)
+			printNames("repaired", report.Repaired)
+			printNames("deleted", report.Deleted)
+		}
+		fmt.Println(report)
+	}
+	return err
+}
+
+func printNames(label string, names []string) {
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", label, name)
+	}
+}
@@ -0,0 +1,7 @@
+// Package web holds the static assets served alongside hosted media.
+package web
+
+import "embed"
+
+//go:embed index.html
+var FS embed.FS